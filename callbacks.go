@@ -0,0 +1,108 @@
+package hoard
+
+// RemovalReason describes why an object left the cache.
+type RemovalReason int
+
+const (
+	// ExpiredByTime means the object was removed because its expiration
+	// policy's duration, idle time or date had passed.
+	ExpiredByTime RemovalReason = iota
+
+	// ExpiredByCondition means the object was removed because the
+	// ExpirationCondition of its expiration policy returned true.
+	ExpiredByCondition
+
+	// EvictedForCapacity means the object was evicted to keep the hoard
+	// within its MaxEntries or MaxCost limits.
+	EvictedForCapacity
+
+	// RemovedExplicitly means the object was removed by calling Remove.
+	RemovedExplicitly
+
+	// ReplacedBySet means the object was replaced by another object stored
+	// for the same key.
+	ReplacedBySet
+
+	// RemovedByClose means the object was removed because the hoard was
+	// closed.
+	RemovedByClose
+)
+
+// String returns a readable name for the reason.
+func (r RemovalReason) String() string {
+	switch r {
+	case ExpiredByTime:
+		return "expired by time"
+	case ExpiredByCondition:
+		return "expired by condition"
+	case EvictedForCapacity:
+		return "evicted for capacity"
+	case RemovedExplicitly:
+		return "removed explicitly"
+	case ReplacedBySet:
+		return "replaced by set"
+	case RemovedByClose:
+		return "removed by close"
+	}
+	return "unknown"
+}
+
+// automatic returns whether the hoard removed the object on its own accord.
+func (r RemovalReason) automatic() bool {
+	return r == ExpiredByTime || r == ExpiredByCondition || r == EvictedForCapacity || r == RemovedByClose
+}
+
+// RemovalCallback is a type for the function signature of the callbacks
+// called when objects leave the cache.
+type RemovalCallback[K comparable, V any] func(key K, data V, reason RemovalReason)
+
+// removal records an object that left the cache, so that the callbacks can
+// be called once the locks have been released.
+type removal[K comparable, V any] struct {
+	key    K
+	object *container[V]
+	reason RemovalReason
+}
+
+// OnEvict sets the callback called when the hoard removes an object on its
+// own, because it expired, was evicted for capacity or the hoard was closed.
+//
+// The callback is called after the object has left the cache and without
+// holding any locks, so it may safely use the hoard. It is called on the
+// thread that caused the removal, which is the flush manager for most
+// expirations, so it should not block for long.
+//
+// This function should be called right after Make()
+func (h *TypedHoard[K, V]) OnEvict(callback RemovalCallback[K, V]) *TypedHoard[K, V] {
+	h.onEvict = callback
+	return h
+}
+
+// OnRemove sets the callback called whenever an object leaves the cache,
+// whatever the reason, including explicit calls to Remove and objects being
+// replaced by Set.
+//
+// Please refer to the documentation for the OnEvict method for more
+// information on how the callback is called.
+//
+// This function should be called right after Make()
+func (h *TypedHoard[K, V]) OnRemove(callback RemovalCallback[K, V]) *TypedHoard[K, V] {
+	h.onRemove = callback
+	return h
+}
+
+// removed calls the callbacks for the removed objects, leaving out cached
+// errors. It must be called without holding any locks.
+func (h *TypedHoard[K, V]) removed(removals []removal[K, V]) {
+	for _, r := range removals {
+		if r.object.err != nil {
+			continue
+		}
+		if h.onEvict != nil && r.reason.automatic() {
+			h.onEvict(r.key, r.object.data, r.reason)
+		}
+		if h.onRemove != nil {
+			h.onRemove(r.key, r.object.data, r.reason)
+		}
+	}
+}
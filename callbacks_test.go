@@ -0,0 +1,88 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// recordedRemoval is a call to a RemovalCallback recorded by a test.
+type recordedRemoval struct {
+	key    string
+	data   interface{}
+	reason RemovalReason
+}
+
+func TestCallbacks(t *testing.T) {
+
+	var evicted, removed []recordedRemoval
+
+	h := Make(ExpiresNever, MaxEntries(2)).OnEvict(func(key string, data interface{}, reason RemovalReason) {
+		evicted = append(evicted, recordedRemoval{key, data, reason})
+	}).OnRemove(func(key string, data interface{}, reason RemovalReason) {
+		removed = append(removed, recordedRemoval{key, data, reason})
+	})
+
+	h.Set("one", 1)
+	h.Set("one", 11)
+	h.Set("two", 2)
+	h.Set("three", 3)
+	h.Remove("two")
+	h.Set("condition", 4, Expires().OnCondition(func() bool { return true }))
+	h.Get("condition")
+
+	assert.Equal(t, []recordedRemoval{
+		{"one", 11, EvictedForCapacity},
+		{"condition", 4, ExpiredByCondition},
+	}, evicted)
+
+	assert.Equal(t, []recordedRemoval{
+		{"one", 1, ReplacedBySet},
+		{"one", 11, EvictedForCapacity},
+		{"two", 2, RemovedExplicitly},
+		{"condition", 4, ExpiredByCondition},
+	}, removed)
+
+}
+
+func TestCallbacks_Sweep(t *testing.T) {
+
+	var evicted []recordedRemoval
+
+	h := Make(ExpiresNever, Shards(1)).OnEvict(func(key string, data interface{}, reason RemovalReason) {
+		evicted = append(evicted, recordedRemoval{key, data, reason})
+	})
+
+	h.Set("key", 1, Expires().AfterSeconds(1))
+	h.Sweep(time.Now().Add(2 * time.Second))
+
+	assert.Equal(t, []recordedRemoval{{"key", 1, ExpiredByTime}}, evicted)
+
+}
+
+func TestCallbacks_Reentrant(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(1))
+	h.OnEvict(func(key string, data interface{}, reason RemovalReason) {
+		// calling back into the hoard must not deadlock
+		h.Set("evicted", key)
+	})
+
+	h.Set("one", 1)
+	h.Set("two", 2)
+
+	assert.Equal(t, "two", h.Get("evicted"))
+
+	h.Set("expiring", 1, Expires().OnCondition(func() bool { return true }))
+	assert.Nil(t, h.Get("expiring"))
+
+}
+
+func TestRemovalReason_String(t *testing.T) {
+
+	assert.Equal(t, "expired by time", ExpiredByTime.String())
+	assert.Equal(t, "replaced by set", ReplacedBySet.String())
+	assert.Equal(t, "removed by close", RemovedByClose.String())
+	assert.Equal(t, "unknown", RemovalReason(42).String())
+
+}
@@ -0,0 +1,195 @@
+package hoard
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells a hoard the time. It drives the creation and access times of
+// objects, their expiration and the ticks of the flush manager.
+//
+// Hoards use the system clock unless another one is set with the WithClock
+// option, which is mostly useful in tests, with a FakeClock.
+type Clock interface {
+
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a Ticker ticking every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a Clock at intervals, like a time.Ticker.
+type Ticker interface {
+
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. No more ticks are delivered after it
+	// returns, but the channel is not closed.
+	Stop()
+}
+
+// Clock returns the Clock the hoard tells the time with, so that code
+// working out times for its objects, such as the time left before they
+// expire, agrees with it.
+func (h *TypedHoard[K, V]) Clock() Clock {
+	return h.clock
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+// Now returns time.Now().
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a time.Ticker ticking every d.
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+// systemTicker is a Ticker backed by a time.Ticker.
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+// C returns the channel of the time.Ticker.
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+// Stop stops the time.Ticker.
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// FakeClock is a Clock whose time only moves when it is told to, so that
+// expiration can be tested without waiting for it.
+//
+// Its tickers tick as Advance moves the time past their intervals. Each
+// ticker holds at most one tick which has not been received, like a
+// time.Ticker, but keeps the latest one rather than the earliest, so that the
+// flush manager always catches up with the clock.
+type FakeClock struct {
+
+	// now is the current time of the clock.
+	now time.Time
+
+	// tickers are the tickers which have not been stopped.
+	tickers []*fakeTicker
+
+	// deadbolt provides thread safety for the clock and its tickers.
+	deadbolt sync.Mutex
+}
+
+// NewFakeClock makes a new *FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.deadbolt.Lock()
+	defer c.deadbolt.Unlock()
+	return c.now
+}
+
+// NewTicker returns a Ticker ticking every d as the clock is advanced.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("hoard: non-positive interval for NewTicker")
+	}
+
+	c.deadbolt.Lock()
+	defer c.deadbolt.Unlock()
+
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), interval: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the time of the clock on by d, delivering the ticks of its
+// tickers which fall due on the way in the order of their times, as a real
+// clock would.
+//
+// Ticks are received by the flush manager in the background, so objects
+// which expire are not removed by the time Advance returns. They are never
+// returned by the hoard once they have expired though.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.deadbolt.Lock()
+	defer c.deadbolt.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, tick := range c.dueTicks() {
+		select {
+		case <-tick.ticker.c:
+		default:
+		}
+		tick.ticker.c <- tick.at
+	}
+}
+
+// dueTicks returns the ticks of the tickers which have fallen due by the
+// current time, sorted by their times, and moves the tickers on past them.
+// The deadbolt must be held by the caller.
+func (c *FakeClock) dueTicks() []fakeTick {
+	var due []fakeTick
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			due = append(due, fakeTick{ticker: t, at: t.next})
+			t.next = t.next.Add(t.interval)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].at.Before(due[j].at)
+	})
+	return due
+}
+
+// fakeTick is a tick of a fakeTicker which has fallen due.
+type fakeTick struct {
+
+	// ticker is the ticker ticking.
+	ticker *fakeTicker
+
+	// at is the time of the tick.
+	at time.Time
+}
+
+// fakeTicker is a Ticker of a FakeClock.
+type fakeTicker struct {
+
+	// clock is the clock the ticker belongs to.
+	clock *FakeClock
+
+	// c is the channel on which the ticks are delivered.
+	c chan time.Time
+
+	// interval is the time between ticks.
+	interval time.Duration
+
+	// next is the time of the next tick. It is protected by the deadbolt of
+	// the clock.
+	next time.Time
+}
+
+// C returns the channel on which the ticks are delivered.
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop removes the ticker from its clock.
+func (t *fakeTicker) Stop() {
+	t.clock.deadbolt.Lock()
+	defer t.clock.deadbolt.Unlock()
+
+	for i, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClock_Advance(t *testing.T) {
+
+	start := time.Now()
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Minute), clock.Now())
+
+}
+
+func TestFakeClock_Ticker(t *testing.T) {
+
+	start := time.Now()
+	clock := NewFakeClock(start)
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Error("ticked too early")
+	default:
+	}
+
+	// only the latest of the ticks which are not received is kept
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, start.Add(5*time.Second), <-ticker.C())
+	select {
+	case <-ticker.C():
+		t.Error("ticks should have been dropped")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(6*time.Second), <-ticker.C())
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("stopped tickers should not tick")
+	default:
+	}
+
+}
+
+func TestFakeClock_TickOrder(t *testing.T) {
+
+	start := time.Now()
+	clock := NewFakeClock(start)
+	slow := clock.NewTicker(3 * time.Second)
+	fast := clock.NewTicker(2 * time.Second)
+
+	// the ticks of all the tickers are delivered in the order of their times
+	clock.deadbolt.Lock()
+	clock.now = start.Add(6 * time.Second)
+	due := clock.dueTicks()
+	clock.deadbolt.Unlock()
+
+	var tickers []Ticker
+	var times []time.Duration
+	for _, tick := range due {
+		tickers = append(tickers, tick.ticker)
+		times = append(times, tick.at.Sub(start))
+	}
+	assert.Equal(t, []Ticker{fast, slow, fast, slow, fast}, tickers)
+	assert.Equal(t, []time.Duration{2 * time.Second, 3 * time.Second, 4 * time.Second, 6 * time.Second, 6 * time.Second}, times)
+
+}
+
+func TestHoard_FakeClockExpiration(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := Make(Expires().AfterSeconds(10), WithClock(clock))
+
+	h.Set("absolute", 1)
+	h.Set("idle", 2, Expires().AfterSecondsIdle(5))
+
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, 2, h.Get("idle"))
+
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, 1, h.Get("absolute"))
+	assert.Equal(t, 2, h.Get("idle"))
+
+	clock.Advance(4 * time.Second)
+	assert.Nil(t, h.Get("absolute"))
+	assert.Equal(t, 2, h.Get("idle"))
+
+	clock.Advance(6 * time.Second)
+	assert.Nil(t, h.Get("idle"))
+
+}
+
+func TestHoard_FakeClockFlush(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := Make(Expires().AfterSeconds(10), WithClock(clock))
+
+	var evicted atomic.Int64
+	h.OnEvict(func(key string, data interface{}, reason RemovalReason) {
+		evicted.Add(1)
+	})
+
+	h.Set("key", 1)
+	clock.Advance(5 * time.Second)
+	assert.True(t, h.Has("key"))
+
+	// the flush manager removes the object on the tick after it expires
+	clock.Advance(6 * time.Second)
+	assert.Condition(t, eventually(func() bool { return !h.Has("key") }))
+	assert.Equal(t, int64(1), evicted.Load())
+
+}
@@ -0,0 +1,63 @@
+package hoard
+
+import (
+	"errors"
+)
+
+// ErrClosed is returned by the methods of a hoard which has been closed.
+var ErrClosed = errors.New("hoard: closed")
+
+// Close shuts the hoard down, releasing its resources. It stops the flush
+// manager and waits for it to finish, unless it is sweeping, in which case
+// the sweep stops after the batch of objects it is removing, so that Close
+// may be called from the OnEvict and OnRemove callbacks. It then cancels the contexts of the
+// DataGetters still running, writes the changes queued by write-behind to
+// the backing store and stops the background writer, and closes the
+// write-ahead log. The objects are then removed from the cache, which calls
+// the OnEvict and OnRemove callbacks with RemovedByClose, so that resources
+// they hold can be released.
+//
+// Once closed, the hoard holds no objects. GetWithError, SetWithError, Flush
+// and the other methods returning an error return ErrClosed, including
+// Close itself, while the others do nothing: Get returns the zero value of
+// V, Set stores nothing and Remove leaves the backing store alone. Data
+// loaded by DataGetters which were already running is not cached.
+func (h *TypedHoard[K, V]) Close() error {
+
+	h.tickerRunningDeadbolt.Lock()
+	if h.closed.Load() {
+		h.tickerRunningDeadbolt.Unlock()
+		return ErrClosed
+	}
+	h.closed.Store(true)
+	close(h.stop)
+	h.tickerRunningDeadbolt.Unlock()
+
+	// a callback of the flush manager closing the hoard cannot wait for
+	// it to stop, so the sweep is left to stop at its next batch instead
+	if !h.flushSweeping.Load() {
+		h.flushManager.Wait()
+	}
+
+	for _, s := range h.shards {
+		s.cancelLoads()
+	}
+
+	var errs []error
+	if h.writeBehind != nil {
+		errs = append(errs, h.writeBehind.close())
+	}
+	errs = append(errs, h.CloseLog())
+
+	for _, s := range h.shards {
+		h.removed(s.close())
+	}
+
+	return errors.Join(errs...)
+
+}
+
+// Closed returns whether the hoard has been closed.
+func (h *TypedHoard[K, V]) Closed() bool {
+	return h.closed.Load()
+}
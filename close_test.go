@@ -0,0 +1,173 @@
+package hoard
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+// tickers returns the number of tickers of the clock which have not been
+// stopped.
+func tickers(clock *FakeClock) int {
+	clock.deadbolt.Lock()
+	defer clock.deadbolt.Unlock()
+	return len(clock.tickers)
+}
+
+func TestHoard_Close(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](Expires().AfterMinutes(1), WithClock(clock))
+
+	var evicted, removed []string
+	h.OnEvict(func(key string, data int, reason RemovalReason) {
+		assert.Equal(t, RemovedByClose, reason)
+		evicted = append(evicted, key)
+	})
+	h.OnRemove(func(key string, data int, reason RemovalReason) {
+		removed = append(removed, key)
+	})
+
+	h.Set("one", 1)
+	h.Set("two", 2, ExpiresNever)
+	assert.Equal(t, 1, tickers(clock))
+
+	assert.NoError(t, h.Close())
+	assert.True(t, h.Closed())
+
+	// the flush manager has stopped
+	assert.Equal(t, 0, tickers(clock))
+
+	sort.Strings(evicted)
+	sort.Strings(removed)
+	assert.Equal(t, []string{"one", "two"}, evicted)
+	assert.Equal(t, []string{"one", "two"}, removed)
+
+	// nothing is stored anymore
+	h.Set("three", 3)
+	assert.False(t, h.Has("three"))
+	assert.Equal(t, 0, h.Get("three", func() (int, *Expiration) {
+		return 3, ExpiresDefault
+	}))
+	assert.Empty(t, h.Keys())
+	assert.Equal(t, 0, tickers(clock))
+
+	_, err := h.GetWithError("one")
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, h.SetWithError("one", 1), ErrClosed)
+	assert.ErrorIs(t, h.Flush(), ErrClosed)
+	assert.ErrorIs(t, h.Close(), ErrClosed)
+
+}
+
+func TestHoard_CloseFromCallback(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](Expires().AfterSeconds(1), WithClock(clock))
+
+	closed := make(chan error, 1)
+	h.OnEvict(func(key string, data int, reason RemovalReason) {
+		if reason == ExpiredByTime {
+			closed <- h.Close()
+		}
+	})
+
+	h.Set("one", 1)
+	h.Set("two", 2, ExpiresNever)
+
+	// the flush manager calls the callback, which closes the hoard without
+	// waiting for the flush manager to stop
+	clock.Advance(2 * time.Second)
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close called from OnEvict did not return")
+	}
+
+	assert.True(t, h.Closed())
+	assert.False(t, h.Has("two"))
+	assert.Condition(t, eventually(func() bool { return tickers(clock) == 0 }))
+
+}
+
+func TestHoard_CloseWritesBehind(t *testing.T) {
+
+	store := newMemoryStore()
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store).SetWriteBehind(time.Hour)
+
+	h.Set("one", 1)
+	assert.NoError(t, h.Close())
+	assert.Equal(t, map[string]int{"one": 1}, store.data)
+
+	// closed hoards leave the store alone
+	h.Remove("one")
+	h.Set("two", 2)
+	assert.Equal(t, map[string]int{"one": 1}, store.data)
+
+}
+
+func TestHoard_CloseWhileSettingBehind(t *testing.T) {
+
+	store := newMemoryStore()
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store).SetWriteBehind(time.Hour)
+
+	// a Set racing Close, which got past the check of the hoard before it
+	// was closed, is refused rather than queued after the last flush
+	assert.NoError(t, h.writeBehind.close())
+	assert.ErrorIs(t, h.SetWithError("one", 1), ErrClosed)
+	h.Set("two", 2)
+	h.Remove("three")
+
+	assert.False(t, h.Has("one"))
+	assert.False(t, h.Has("two"))
+	assert.Empty(t, h.writeBehind.pending)
+	assert.Empty(t, store.data)
+
+}
+
+func TestHoard_CloseCancelsLoads(t *testing.T) {
+
+	h := MakeTyped[string, int](ExpiresNever)
+	started := make(chan struct{})
+
+	result := make(chan error)
+	go func() {
+		_, err := h.GetWithErrorContext(context.Background(), "key", func(ctx context.Context) (int, error, *Expiration) {
+			close(started)
+			<-ctx.Done()
+			return 1, ctx.Err(), nil
+		})
+		result <- err
+	}()
+
+	<-started
+	assert.NoError(t, h.Close())
+	assert.ErrorIs(t, <-result, context.Canceled)
+	assert.False(t, h.Has("key"))
+
+}
+
+func TestHoard_FlushManagerStopsWhenIdle(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](Expires().AfterSeconds(1), WithClock(clock))
+
+	h.Set("key", 1)
+	assert.Equal(t, 1, tickers(clock))
+
+	// the first tick removes the object, the next one stops the ticker
+	clock.Advance(2 * time.Second)
+	assert.Condition(t, eventually(func() bool { return h.expirationCacheLen() == 0 }))
+	clock.Advance(time.Second)
+	assert.Condition(t, eventually(func() bool { return tickers(clock) == 0 }))
+
+	// it starts again with the next expirable object
+	h.Set("key", 1)
+	assert.Equal(t, 1, tickers(clock))
+	assert.NoError(t, h.Close())
+	assert.Equal(t, 0, tickers(clock))
+
+}
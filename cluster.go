@@ -0,0 +1,323 @@
+package hoard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ClusterPath is the path under which peers serve each other's requests. The
+// Cluster should be registered with it on the server of every peer.
+const ClusterPath = "/_hoard/"
+
+// ringReplicas is the number of points each peer has on the hash ring, which
+// evens out the share of the keys each peer owns.
+const ringReplicas = 64
+
+// ClusterDataGetter is a type for the function signature used by a Cluster to
+// load the data of type V for a key it owns.
+type ClusterDataGetter[V any] func(ctx context.Context, key string) (V, error, *Expiration)
+
+// Cluster is a cache shared by a group of peers, usually replicas of the same
+// service, each owning a part of the keys.
+//
+// Every key is owned by one peer, chosen by consistent hashing so that only a
+// few keys change owners when peers come and go. The owner holds the data in
+// its own hoard and is the only peer calling the ClusterDataGetter for the
+// key, while other peers fetch the data from it over HTTP. Since concurrent
+// Gets of a key share a single call, the data is loaded once for the whole
+// cluster.
+//
+// If the owner cannot be reached, the data is loaded by the asking peer
+// instead, so that the cluster keeps working while peers restart.
+//
+// Example
+//
+//     users := hoard.MakeCluster[*User]("http://10.0.0.1:8080", hoard.Expires().AfterMinutes(5), loadUser)
+//     users.SetPeers("http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080")
+//     http.Handle(hoard.ClusterPath, users)
+//
+//     user, err := users.Get(ctx, "42")
+type Cluster[V any] struct {
+
+	// self is the base URL of this peer.
+	self string
+
+	// ring maps the keys to the peers owning them.
+	ring *hashRing
+
+	// ringDeadbolt provides thread safety for the ring.
+	ringDeadbolt sync.RWMutex
+
+	// local holds the data of the keys owned by this peer.
+	local *TypedHoard[string, V]
+
+	// getter loads the data of the keys owned by this peer.
+	getter ClusterDataGetter[V]
+
+	// mirror holds copies of data owned by other peers, or is nil.
+	mirror *TypedHoard[string, V]
+
+	// mirrorOneIn is the inverse of the chance of data fetched from another
+	// peer being copied into the mirror.
+	mirrorOneIn int
+
+	// codec encodes the data sent between peers.
+	codec Codec
+
+	// client is used to fetch data from other peers.
+	client *http.Client
+}
+
+// MakeCluster creates a new *Cluster for the peer reachable at the base URL
+// self, which loads the data of the keys it owns with dataGetter.
+//
+// The defaultExpiration and Options are used to make the hoard holding the
+// data owned by the peer. Until SetPeers is called, the peer owns all keys.
+func MakeCluster[V any](self string, defaultExpiration *Expiration, dataGetter ClusterDataGetter[V], opts ...Option) *Cluster[V] {
+	return &Cluster[V]{
+		self:   self,
+		ring:   makeHashRing([]string{self}),
+		local:  MakeTyped[string, V](defaultExpiration, opts...),
+		getter: dataGetter,
+		codec:  GobCodec,
+		client: http.DefaultClient,
+	}
+}
+
+// SetPeers sets the base URLs of all the peers in the cluster, which should
+// include this peer. It may be called at any time as peers come and go.
+func (c *Cluster[V]) SetPeers(peers ...string) *Cluster[V] {
+	ring := makeHashRing(peers)
+	c.ringDeadbolt.Lock()
+	c.ring = ring
+	c.ringDeadbolt.Unlock()
+	return c
+}
+
+// SetMirror keeps copies of data fetched from other peers in the mirror
+// hoard, so that hot keys are not fetched over and over again. The data is
+// copied with a chance of one in oneIn, so keys that are asked for often are
+// soon mirrored while rarely used ones mostly are not.
+//
+// The mirror hoard should have a short default expiration, since changes to
+// the data on its owner are not passed on to it.
+//
+// This function should be called right after MakeCluster()
+func (c *Cluster[V]) SetMirror(mirror *TypedHoard[string, V], oneIn int) *Cluster[V] {
+	c.mirror = mirror
+	c.mirrorOneIn = oneIn
+	return c
+}
+
+// SetCodec sets the codec used to encode the data sent between peers, which
+// must be the same for all peers.
+//
+// Default is GobCodec.
+func (c *Cluster[V]) SetCodec(codec Codec) *Cluster[V] {
+	c.codec = codec
+	return c
+}
+
+// SetClient sets the HTTP client used to fetch data from other peers.
+//
+// Default is http.DefaultClient.
+func (c *Cluster[V]) SetClient(client *http.Client) *Cluster[V] {
+	c.client = client
+	return c
+}
+
+// Local returns the hoard holding the data owned by this peer, such as for
+// registering it with a MetricsHandler.
+func (c *Cluster[V]) Local() *TypedHoard[string, V] {
+	return c.local
+}
+
+// owner returns the base URL of the peer owning the key.
+func (c *Cluster[V]) owner(key string) string {
+	c.ringDeadbolt.RLock()
+	owner := c.ring.owner(key)
+	c.ringDeadbolt.RUnlock()
+	return owner
+}
+
+// Get retrieves the data for the key, from this peer if it owns the key and
+// from its owner otherwise.
+//
+// Errors returned by the ClusterDataGetter of the owner are returned by Get,
+// and the data is not cached.
+func (c *Cluster[V]) Get(ctx context.Context, key string) (V, error) {
+
+	owner := c.owner(key)
+	if owner == "" || owner == c.self {
+		return c.getLocally(ctx, key)
+	}
+
+	if c.mirror != nil {
+		if data, ok := c.mirror.lookup(key); ok {
+			return data, nil
+		}
+	}
+
+	data, err := c.fetch(ctx, owner, key)
+
+	var peerErr *PeerError
+	if err != nil && !errors.As(err, &peerErr) && ctx.Err() == nil {
+		// the owner cannot be reached, so the data is loaded here instead
+		return c.getLocally(ctx, key)
+	}
+	if err != nil {
+		return data, err
+	}
+
+	if c.mirror != nil && (c.mirrorOneIn <= 1 || rand.IntN(c.mirrorOneIn) == 0) {
+		c.mirror.Set(key, data)
+	}
+
+	return data, nil
+
+}
+
+// getLocally retrieves the data for the key from the local hoard, loading
+// it if it is missing.
+func (c *Cluster[V]) getLocally(ctx context.Context, key string) (V, error) {
+	return c.local.GetWithErrorContext(ctx, key, func(ctx context.Context) (V, error, *Expiration) {
+		return c.getter(ctx, key)
+	})
+}
+
+// PeerError is returned by Get when the ClusterDataGetter of the peer owning
+// the key returned an error.
+type PeerError struct {
+
+	// Peer is the base URL of the peer owning the key.
+	Peer string
+
+	// Message is the message of the error returned by the ClusterDataGetter.
+	Message string
+}
+
+// Error returns the message of the error.
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("hoard: peer %s: %s", e.Peer, e.Message)
+}
+
+// fetch retrieves the data for the key from the peer owning it.
+func (c *Cluster[V]) fetch(ctx context.Context, peer, key string) (V, error) {
+
+	var data V
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+ClusterPath+"?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return data, err
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return data, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return data, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		err = c.codec.Unmarshal(body, &data)
+		return data, err
+	case http.StatusInternalServerError:
+		return data, &PeerError{Peer: peer, Message: string(bytes.TrimSpace(body))}
+	}
+
+	return data, fmt.Errorf("hoard: peer %s: %s", peer, response.Status)
+
+}
+
+// ServeHTTP serves the requests of other peers for data owned by this peer.
+//
+// The data is always retrieved from the local hoard, even if the peer does
+// not think it owns the key, so that requests never bounce between peers
+// which disagree about who the peers are.
+func (c *Cluster[V]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+
+	data, err := c.getLocally(r.Context(), key)
+	if err != nil {
+		if r.Context().Err() != nil {
+			// the asking peer has gone away
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body, err := c.codec.Marshal(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+
+}
+
+// hashRing assigns keys to peers by consistent hashing.
+type hashRing struct {
+
+	// hashes are the points of the peers on the ring, in order.
+	hashes []uint32
+
+	// peers maps the points to the peers they belong to.
+	peers map[uint32]string
+}
+
+// makeHashRing creates a new *hashRing with the given peers.
+func makeHashRing(peers []string) *hashRing {
+	r := &hashRing{peers: make(map[uint32]string, len(peers)*ringReplicas)}
+	for _, peer := range peers {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			r.hashes = append(r.hashes, hash)
+			r.peers[hash] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// owner returns the peer owning the key, which is the one with the first
+// point on the ring at or after the hash of the key, or an empty string if
+// there are no peers.
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.peers[r.hashes[i]]
+}
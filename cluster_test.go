@@ -0,0 +1,178 @@
+package hoard
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testCluster is a group of in-process peers serving each other on loopback.
+type testCluster struct {
+	peers    []*Cluster[string]
+	servers  []*httptest.Server
+	loads    atomic.Int64
+	requests atomic.Int64
+}
+
+// makeTestCluster starts n peers loading data with getter, or with a getter
+// returning "data:" + key if it is nil.
+func makeTestCluster(t *testing.T, n int, getter ClusterDataGetter[string]) *testCluster {
+	tc := new(testCluster)
+
+	if getter == nil {
+		getter = func(ctx context.Context, key string) (string, error, *Expiration) {
+			return "data:" + key, nil, ExpiresDefault
+		}
+	}
+	counted := func(ctx context.Context, key string) (string, error, *Expiration) {
+		tc.loads.Add(1)
+		return getter(ctx, key)
+	}
+
+	urls := make([]string, n)
+	for i := 0; i < n; i++ {
+		var peer *Cluster[string]
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tc.requests.Add(1)
+			peer.ServeHTTP(w, r)
+		}))
+		t.Cleanup(server.Close)
+
+		peer = MakeCluster[string](server.URL, ExpiresNever, counted)
+		urls[i] = server.URL
+		tc.peers = append(tc.peers, peer)
+		tc.servers = append(tc.servers, server)
+	}
+
+	for _, peer := range tc.peers {
+		peer.SetPeers(urls...)
+	}
+
+	return tc
+}
+
+// keyOwnedBy returns a key owned by the peer.
+func (tc *testCluster) keyOwnedBy(peer *Cluster[string]) string {
+	for i := 0; ; i++ {
+		key := "key" + strconv.Itoa(i)
+		if peer.owner(key) == peer.self {
+			return key
+		}
+	}
+}
+
+func TestCluster_LoadsOnce(t *testing.T) {
+
+	tc := makeTestCluster(t, 3, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(peer *Cluster[string]) {
+			defer wg.Done()
+			data, err := peer.Get(context.Background(), "shared")
+			assert.NoError(t, err)
+			assert.Equal(t, "data:shared", data)
+		}(tc.peers[i%3])
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), tc.loads.Load())
+
+	// only the owner holds the data
+	holders := 0
+	for _, peer := range tc.peers {
+		if peer.Local().Has("shared") {
+			holders++
+			assert.Equal(t, peer.self, peer.owner("shared"))
+		}
+	}
+	assert.Equal(t, 1, holders)
+
+}
+
+func TestCluster_Owners(t *testing.T) {
+
+	tc := makeTestCluster(t, 3, nil)
+
+	// all peers agree on the owners, and every peer owns some keys
+	owned := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := strconv.Itoa(i)
+		owner := tc.peers[0].owner(key)
+		for _, peer := range tc.peers[1:] {
+			assert.Equal(t, owner, peer.owner(key))
+		}
+		owned[owner]++
+	}
+	assert.Equal(t, 3, len(owned))
+
+	// removing a peer only moves its own keys
+	moved := makeHashRing([]string{tc.peers[0].self, tc.peers[1].self})
+	for i := 0; i < 300; i++ {
+		key := strconv.Itoa(i)
+		if owner := tc.peers[0].owner(key); owner != tc.peers[2].self {
+			assert.Equal(t, owner, moved.owner(key))
+		}
+	}
+
+}
+
+func TestCluster_Error(t *testing.T) {
+
+	tc := makeTestCluster(t, 2, func(ctx context.Context, key string) (string, error, *Expiration) {
+		return "", errors.New("EXTERMINATE!!!"), ExpiresDefault
+	})
+
+	key := tc.keyOwnedBy(tc.peers[1])
+	_, err := tc.peers[0].Get(context.Background(), key)
+
+	var peerErr *PeerError
+	if assert.True(t, errors.As(err, &peerErr)) {
+		assert.Equal(t, tc.peers[1].self, peerErr.Peer)
+		assert.Equal(t, "EXTERMINATE!!!", peerErr.Message)
+	}
+
+	// the asking peer does not try to load the data itself
+	assert.Equal(t, int64(1), tc.loads.Load())
+
+}
+
+func TestCluster_OwnerDown(t *testing.T) {
+
+	tc := makeTestCluster(t, 2, nil)
+
+	key := tc.keyOwnedBy(tc.peers[1])
+	tc.servers[1].Close()
+
+	data, err := tc.peers[0].Get(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, "data:"+key, data)
+	assert.True(t, tc.peers[0].Local().Has(key))
+
+}
+
+func TestCluster_Mirror(t *testing.T) {
+
+	tc := makeTestCluster(t, 2, nil)
+	mirror := MakeTyped[string, string](ExpiresNever)
+	tc.peers[0].SetMirror(mirror, 1)
+
+	key := tc.keyOwnedBy(tc.peers[1])
+	for i := 0; i < 3; i++ {
+		data, err := tc.peers[0].Get(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, "data:"+key, data)
+	}
+
+	assert.Equal(t, int64(1), tc.requests.Load())
+	assert.Equal(t, "data:"+key, mirror.Get(key))
+	assert.False(t, tc.peers[0].Local().Has(key))
+
+}
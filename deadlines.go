@@ -0,0 +1,204 @@
+package hoard
+
+import (
+	"time"
+)
+
+// deadline is an object in the deadlines or conditions of a shard.
+type deadline[K comparable, V any] struct {
+	key    K
+	object *container[V]
+}
+
+// deadlines is a min-heap of the objects of a shard which expire by time,
+// ordered by when the flush manager next needs to look at them, so that each
+// tick only touches the objects which are due.
+//
+// The time an object is due is worked out when it is added, and not updated
+// when the object is accessed, so that hits never touch the heap. Objects
+// expiring after being idle are looked at when their original deadline
+// passes, and put back with their new one.
+//
+// Every object knows its position in the heap, so that it can be removed
+// when it leaves the cache.
+type deadlines[K comparable, V any] []deadline[K, V]
+
+// push adds the object to the heap.
+func (d *deadlines[K, V]) push(key K, object *container[V]) {
+	*d = append(*d, deadline[K, V]{key, object})
+	object.slot = len(*d)
+	d.up(len(*d) - 1)
+}
+
+// due returns the object due first, if it is due at currentTime.
+func (d deadlines[K, V]) due(currentTime int64) (deadline[K, V], bool) {
+	if len(d) == 0 || d[0].object.due > currentTime {
+		return deadline[K, V]{}, false
+	}
+	return d[0], true
+}
+
+// remove removes the object from the heap, if it is in it.
+func (d *deadlines[K, V]) remove(object *container[V]) {
+	if object.slot == 0 {
+		return
+	}
+
+	i := object.slot - 1
+	last := len(*d) - 1
+	if i != last {
+		d.swap(i, last)
+	}
+
+	(*d)[last] = deadline[K, V]{}
+	*d = (*d)[:last]
+	object.slot = 0
+
+	if i != last {
+		d.down(i)
+		d.up(i)
+	}
+}
+
+// less returns whether the object at i is due before the one at j.
+func (d deadlines[K, V]) less(i, j int) bool {
+	return d[i].object.due < d[j].object.due
+}
+
+// swap swaps the objects at i and j, keeping track of their positions.
+func (d deadlines[K, V]) swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+	d[i].object.slot = i + 1
+	d[j].object.slot = j + 1
+}
+
+// up moves the object at i up the heap until its parent is due first.
+func (d deadlines[K, V]) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !d.less(i, parent) {
+			return
+		}
+		d.swap(i, parent)
+		i = parent
+	}
+}
+
+// down moves the object at i down the heap until it is due before its
+// children.
+func (d deadlines[K, V]) down(i int) {
+	for {
+		first := i
+		if left := 2*i + 1; left < len(d) && d.less(left, first) {
+			first = left
+		}
+		if right := 2*i + 2; right < len(d) && d.less(right, first) {
+			first = right
+		}
+		if first == i {
+			return
+		}
+		d.swap(i, first)
+		i = first
+	}
+}
+
+// conditions is the list of the objects of a shard with an expiration
+// condition, which the flush manager checks in turn, so that a sweep with a
+// limited budget carries on where the previous one stopped.
+//
+// Every object knows its position in the list, so that it can be removed
+// when it leaves the cache.
+type conditions[K comparable, V any] []deadline[K, V]
+
+// add adds the object to the list, unless it is in it already.
+func (c *conditions[K, V]) add(key K, object *container[V]) {
+	if object.conditionSlot != 0 {
+		return
+	}
+	*c = append(*c, deadline[K, V]{key, object})
+	object.conditionSlot = len(*c)
+}
+
+// remove removes the object from the list, if it is in it, moving the last
+// object into its place.
+func (c *conditions[K, V]) remove(object *container[V]) {
+	if object.conditionSlot == 0 {
+		return
+	}
+
+	i := object.conditionSlot - 1
+	last := len(*c) - 1
+	(*c)[i] = (*c)[last]
+	(*c)[i].object.conditionSlot = i + 1
+
+	(*c)[last] = deadline[K, V]{}
+	*c = (*c)[:last]
+	object.conditionSlot = 0
+}
+
+// checkAt returns when the flush manager next needs to look at this entry
+// after currentTime, which is when its refresh-ahead window starts or when it
+// is to be removed, and false if it never expires by time.
+func (c *container[V]) checkAt(currentTime time.Time) (time.Time, bool) {
+	e := c.expiration
+	abs := c.absoluteTime()
+	if abs.IsZero() {
+		return abs, false
+	}
+	if e.refreshAhead != 0 && c.err == nil {
+		if start := abs.Add(-e.refreshAhead); currentTime.Before(start) {
+			return start, true
+		}
+	}
+	removal := abs.Add(e.stale)
+	if c.err == nil {
+		removal = removal.Add(e.staleIfError)
+	}
+	return removal, true
+}
+
+// inRefreshWindowAt returns whether this entry is within its refresh-ahead
+// window at currentTime.
+func (c *container[V]) inRefreshWindowAt(currentTime time.Time) bool {
+	e := c.expiration
+	if e.refreshAhead == 0 || c.err != nil {
+		return false
+	}
+	abs := c.absoluteTime()
+	return !abs.IsZero() && !currentTime.Before(abs.Add(-e.refreshAhead)) && !currentTime.After(abs)
+}
+
+// schedule makes the flush manager look at the object when it is next due,
+// and on every tick if it has an expiration condition or is within its
+// refresh-ahead window. The expirationDeadbolt must be held by the caller.
+func (s *shard[K, V]) schedule(key K, object *container[V], currentTime time.Time) {
+	if object.expiration.condition != nil {
+		s.conditions.add(key, object)
+	}
+	if object.inRefreshWindowAt(currentTime) {
+		s.refreshing[key] = object
+	}
+
+	at, ok := object.checkAt(currentTime)
+	if !ok {
+		return
+	}
+	// the object is put back if it is not removed when it is due, so it
+	// must not be due again at the same time
+	if !at.After(currentTime) {
+		at = currentTime.Add(1)
+	}
+	object.due = at.UnixNano()
+	s.deadlines.push(key, object)
+}
+
+// unschedule stops the flush manager from looking at the object. The
+// expirationDeadbolt must be held by the caller.
+func (s *shard[K, V]) unschedule(key K, object *container[V]) {
+	s.deadlines.remove(object)
+	s.conditions.remove(object)
+	if s.refreshing[key] == object {
+		delete(s.refreshing, key)
+	}
+}
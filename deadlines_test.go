@@ -0,0 +1,176 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeadlines(t *testing.T) {
+
+	var d deadlines[int, int]
+	objects := make([]*container[int], 1000)
+	for i := range objects {
+		objects[i] = &container[int]{due: rand.Int63n(100)}
+		d.push(i, objects[i])
+	}
+
+	// removing objects from the middle keeps the heap in order
+	for i := 0; i < len(objects); i += 3 {
+		d.remove(objects[i])
+		assert.Equal(t, 0, objects[i].slot)
+	}
+	d.remove(objects[0])
+
+	for i, entry := range d {
+		assert.Equal(t, i+1, entry.object.slot)
+	}
+
+	previous := int64(-1)
+	count := 0
+	for {
+		due, ok := d.due(100)
+		if !ok {
+			break
+		}
+		assert.True(t, due.object.due >= previous)
+		assert.NotEqual(t, 0, due.key%3)
+		previous = due.object.due
+		d.remove(due.object)
+		count++
+	}
+	assert.Equal(t, 666, count)
+
+}
+
+func TestConditions(t *testing.T) {
+
+	var c conditions[int, int]
+	objects := make([]*container[int], 10)
+	for i := range objects {
+		objects[i] = &container[int]{}
+		c.add(i, objects[i])
+	}
+	c.add(0, objects[0])
+	assert.Equal(t, 10, len(c))
+
+	c.remove(objects[3])
+	c.remove(objects[9])
+	c.remove(objects[3])
+	assert.Equal(t, 8, len(c))
+	assert.Equal(t, 0, objects[3].conditionSlot)
+
+	for i, entry := range c {
+		assert.Equal(t, i+1, entry.object.conditionSlot)
+		assert.NotEqual(t, 3, entry.key)
+		assert.NotEqual(t, 9, entry.key)
+	}
+
+}
+
+func TestShard_SweepOnlyDue(t *testing.T) {
+
+	h := MakeTyped[string, int](ExpiresNever, Shards(1))
+	s := h.shards[0]
+
+	h.Set("soon", 1, Expires().AfterSeconds(1))
+	h.Set("later", 2, Expires().AfterHours(1))
+	h.Set("idle", 3, Expires().AfterSecondsIdle(1))
+	h.Set("never", 4, Expires())
+
+	assert.Equal(t, 3, len(s.deadlines))
+	assert.Equal(t, 4, s.expirationCacheLen())
+
+	// the idle object has been accessed since it was added, so it is put
+	// back with its new deadline rather than removed
+	object, _ := s.cacheGet("idle")
+	object.touch(time.Now().Add(2 * time.Second))
+
+	assert.Equal(t, 1, h.Sweep(time.Now().Add(2*time.Second)))
+	_, ok := s.cacheGet("soon")
+	assert.False(t, ok)
+	assert.True(t, h.Has("idle"))
+	assert.Equal(t, 2, len(s.deadlines))
+	assert.True(t, object.due > time.Now().Add(2*time.Second).UnixNano())
+
+	assert.Equal(t, 1, h.Sweep(time.Now().Add(4*time.Second)))
+	_, ok = s.cacheGet("idle")
+	assert.False(t, ok)
+
+	// removed and replaced objects leave the deadlines
+	h.Remove("later")
+	h.Set("never", 5, Expires().AfterHours(1))
+	h.Set("never", 6)
+	assert.Equal(t, 0, len(s.deadlines))
+
+}
+
+func TestShard_SweepConditions(t *testing.T) {
+
+	var reasons []RemovalReason
+	h := MakeTyped[string, int](ExpiresNever, Shards(1)).OnEvict(func(key string, data int, reason RemovalReason) {
+		reasons = append(reasons, reason)
+	})
+	s := h.shards[0]
+	expired := false
+
+	h.Set("key", 1, Expires().AfterHours(1).OnCondition(func() bool { return expired }))
+	assert.Equal(t, 1, len(s.conditions))
+
+	assert.Equal(t, 0, h.Sweep(time.Now()))
+
+	expired = true
+	assert.Equal(t, 1, h.Sweep(time.Now()))
+	assert.Equal(t, []RemovalReason{ExpiredByCondition}, reasons)
+	assert.Equal(t, 0, len(s.conditions))
+	assert.Equal(t, 0, len(s.deadlines))
+
+}
+
+// makeExpiringShard makes a hoard with a single shard holding a million
+// objects expiring in an hour.
+func makeExpiringShard() *TypedHoard[string, int] {
+	h := MakeTyped[string, int](Expires().AfterHours(1), Shards(1))
+	for i := 0; i < 1000000; i++ {
+		h.Set(strconv.Itoa(i), i)
+	}
+	return h
+}
+
+func BenchmarkShard_SweepNoneDue_1M(b *testing.B) {
+
+	h := makeExpiringShard()
+	now := time.Now()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Sweep(now)
+	}
+
+}
+
+func BenchmarkShard_SweepOneDue_1M(b *testing.B) {
+
+	h := makeExpiringShard()
+	expired := Expires().OnDate(time.Now().Add(-time.Second))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Set("expired", i, expired)
+		h.Sweep(time.Now())
+	}
+
+}
+
+func BenchmarkHoard_SetExpiring_1M(b *testing.B) {
+
+	h := makeExpiringShard()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Set(strconv.Itoa(i%1000000), i)
+	}
+
+}
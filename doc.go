@@ -23,6 +23,17 @@
 //
 //    }
 //
+// Typed Hoards
+//
+// If you know the types of your keys and data up front, use a TypedHoard
+// to have the compiler check them for you instead of type asserting the
+// results:
+//    users := hoard.MakeTyped[int, *User](hoard.Expires().AfterMinutes(5))
+//
+//    user := users.Get(id, func() (*User, *hoard.Expiration) {
+//      return LoadUser(id), hoard.ExpiresDefault
+//    })
+//
 // There are alternative ways to place data in the cache, such as a standard
 // "Set" method. Please see the documentation of the individual functions for
 // more details.
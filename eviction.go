@@ -0,0 +1,317 @@
+package hoard
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy decides which object is evicted when a hoard made with the
+// MaxEntries option is full.
+//
+// The hoard calls the methods of the policy while holding its own lock, so
+// implementations do not need to be thread safe, but they must not call back
+// into the hoard. Every shard of a hoard has its own policy, see
+// SetEvictionPolicy.
+type EvictionPolicy[K comparable] interface {
+
+	// Added is called when a new key is placed in the cache.
+	Added(key K)
+
+	// Accessed is called when a key in the cache is retrieved or
+	// overwritten. Keys the policy does not know about must be ignored.
+	Accessed(key K)
+
+	// Removed is called when a key leaves the cache for any reason other
+	// than being chosen by Evict. Keys the policy does not know about must be
+	// ignored.
+	Removed(key K)
+
+	// Evict chooses the key to evict from the cache and stops tracking it.
+	// It is called to make room before a new key is added to a full cache,
+	// and returns false if the policy is not tracking any keys.
+	Evict() (K, bool)
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy[K comparable] struct {
+
+	// order holds the keys, most recently used first.
+	order *list.List
+
+	// elements maps the keys to their element in order.
+	elements map[K]*list.Element
+}
+
+// NewLRU creates an EvictionPolicy that evicts the least recently used
+// object. This is the policy used if none is set.
+//
+// The capacity is the number of objects the policy is expected to track.
+func NewLRU[K comparable](capacity int) EvictionPolicy[K] {
+	return &lruPolicy[K]{order: list.New(), elements: make(map[K]*list.Element, capacity)}
+}
+
+// Added is called when a new key is placed in the cache.
+func (p *lruPolicy[K]) Added(key K) {
+	if element, ok := p.elements[key]; ok {
+		p.order.MoveToFront(element)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+// Accessed is called when a key in the cache is retrieved or overwritten.
+func (p *lruPolicy[K]) Accessed(key K) {
+	if element, ok := p.elements[key]; ok {
+		p.order.MoveToFront(element)
+	}
+}
+
+// Removed is called when a key leaves the cache.
+func (p *lruPolicy[K]) Removed(key K) {
+	if element, ok := p.elements[key]; ok {
+		p.order.Remove(element)
+		delete(p.elements, key)
+	}
+}
+
+// Evict chooses the least recently used key.
+func (p *lruPolicy[K]) Evict() (K, bool) {
+	element := p.order.Back()
+	if element == nil {
+		var key K
+		return key, false
+	}
+	key := p.order.Remove(element).(K)
+	delete(p.elements, key)
+	return key, true
+}
+
+// lfuItem is a key tracked by the lfuPolicy.
+type lfuItem[K comparable] struct {
+	key K
+
+	// hits is the number of times the key has been accessed.
+	hits uint64
+
+	// touched orders items with the same number of hits, so that the least
+	// recently used of them is evicted first.
+	touched uint64
+
+	// index is the position of the item in the heap.
+	index int
+}
+
+// lfuHeap is a min-heap of lfuItems ordered by hits.
+type lfuHeap[K comparable] []*lfuItem[K]
+
+func (q lfuHeap[K]) Len() int { return len(q) }
+
+func (q lfuHeap[K]) Less(i, j int) bool {
+	if q[i].hits == q[j].hits {
+		return q[i].touched < q[j].touched
+	}
+	return q[i].hits < q[j].hits
+}
+
+func (q lfuHeap[K]) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *lfuHeap[K]) Push(x interface{}) {
+	item := x.(*lfuItem[K])
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *lfuHeap[K]) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// lfuPolicy evicts the least frequently used key.
+type lfuPolicy[K comparable] struct {
+	queue lfuHeap[K]
+	items map[K]*lfuItem[K]
+
+	// clock is incremented on every operation to order the items.
+	clock uint64
+}
+
+// NewLFU creates an EvictionPolicy that evicts the least frequently used
+// object. Objects used equally often are evicted least recently used first.
+//
+// The capacity is the number of objects the policy is expected to track.
+func NewLFU[K comparable](capacity int) EvictionPolicy[K] {
+	return &lfuPolicy[K]{queue: make(lfuHeap[K], 0, capacity), items: make(map[K]*lfuItem[K], capacity)}
+}
+
+// Added is called when a new key is placed in the cache.
+func (p *lfuPolicy[K]) Added(key K) {
+	if _, ok := p.items[key]; ok {
+		p.Accessed(key)
+		return
+	}
+	p.clock++
+	item := &lfuItem[K]{key: key, touched: p.clock}
+	p.items[key] = item
+	heap.Push(&p.queue, item)
+}
+
+// Accessed is called when a key in the cache is retrieved or overwritten.
+func (p *lfuPolicy[K]) Accessed(key K) {
+	if item, ok := p.items[key]; ok {
+		p.clock++
+		item.hits++
+		item.touched = p.clock
+		heap.Fix(&p.queue, item.index)
+	}
+}
+
+// Removed is called when a key leaves the cache.
+func (p *lfuPolicy[K]) Removed(key K) {
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.queue, item.index)
+		delete(p.items, key)
+	}
+}
+
+// Evict chooses the least frequently used key.
+func (p *lfuPolicy[K]) Evict() (K, bool) {
+	if len(p.queue) == 0 {
+		var key K
+		return key, false
+	}
+	item := heap.Pop(&p.queue).(*lfuItem[K])
+	delete(p.items, item.key)
+	return item.key, true
+}
+
+// arcPolicy implements the Adaptive Replacement Cache algorithm, which
+// balances between recency and frequency depending on the workload.
+//
+// Keys seen once live in recent, keys seen more than once in frequent. The
+// ghost lists remember recently evicted keys, and a hit on a ghost shifts
+// the target size of recent towards the list that would have kept it.
+type arcPolicy[K comparable] struct {
+
+	// capacity is the number of entries the cache holds.
+	capacity int
+
+	// target is the preferred size of recent.
+	target int
+
+	recent, frequent, recentGhosts, frequentGhosts *list.List
+
+	// elements maps the keys to their element in one of the lists.
+	elements map[K]*list.Element
+
+	// lists maps the keys to the list their element is in.
+	lists map[K]*list.List
+}
+
+// NewARC creates an EvictionPolicy that implements the Adaptive Replacement
+// Cache algorithm.
+//
+// The capacity is the number of objects the cache holds, which is used to
+// size the lists of the algorithm. It is zero if only the MaxCost of the
+// hoard is limited, in which case ARC is no better than LRU.
+func NewARC[K comparable](capacity int) EvictionPolicy[K] {
+	return &arcPolicy[K]{
+		capacity:       capacity,
+		recent:         list.New(),
+		frequent:       list.New(),
+		recentGhosts:   list.New(),
+		frequentGhosts: list.New(),
+		elements:       make(map[K]*list.Element),
+		lists:          make(map[K]*list.List),
+	}
+}
+
+// move places the key at the front of the list, taking it out of the list
+// it is currently in.
+func (p *arcPolicy[K]) move(key K, to *list.List) {
+	p.forget(key)
+	p.elements[key] = to.PushFront(key)
+	p.lists[key] = to
+}
+
+// forget removes the key from whichever list it is in.
+func (p *arcPolicy[K]) forget(key K) {
+	if from, ok := p.lists[key]; ok {
+		from.Remove(p.elements[key])
+		delete(p.elements, key)
+		delete(p.lists, key)
+	}
+}
+
+// trimGhosts keeps the ghost lists within the capacity of the cache.
+func (p *arcPolicy[K]) trimGhosts() {
+	for _, ghosts := range []*list.List{p.recentGhosts, p.frequentGhosts} {
+		for ghosts.Len() > p.capacity {
+			p.forget(ghosts.Back().Value.(K))
+		}
+	}
+}
+
+// Added is called when a new key is placed in the cache.
+func (p *arcPolicy[K]) Added(key K) {
+	switch p.lists[key] {
+	case p.recent, p.frequent:
+		p.move(key, p.frequent)
+	case p.recentGhosts:
+		// recent was too small to keep this key
+		p.target += max(p.frequentGhosts.Len()/p.recentGhosts.Len(), 1)
+		p.target = min(p.target, p.capacity)
+		p.move(key, p.frequent)
+	case p.frequentGhosts:
+		// frequent was too small to keep this key
+		p.target -= max(p.recentGhosts.Len()/p.frequentGhosts.Len(), 1)
+		p.target = max(p.target, 0)
+		p.move(key, p.frequent)
+	default:
+		p.move(key, p.recent)
+	}
+}
+
+// Accessed is called when a key in the cache is retrieved or overwritten.
+func (p *arcPolicy[K]) Accessed(key K) {
+	switch p.lists[key] {
+	case p.recent, p.frequent:
+		p.move(key, p.frequent)
+	}
+}
+
+// Removed is called when a key leaves the cache.
+func (p *arcPolicy[K]) Removed(key K) {
+	switch p.lists[key] {
+	case p.recent, p.frequent:
+		p.forget(key)
+	}
+}
+
+// Evict chooses the least recently used key of recent if it is larger than
+// its target size, or of frequent otherwise.
+func (p *arcPolicy[K]) Evict() (K, bool) {
+
+	from, ghosts := p.frequent, p.frequentGhosts
+	if p.recent.Len() > 0 && (p.recent.Len() > p.target || p.frequent.Len() == 0) {
+		from, ghosts = p.recent, p.recentGhosts
+	}
+
+	element := from.Back()
+	if element == nil {
+		var key K
+		return key, false
+	}
+
+	key := element.Value.(K)
+	p.move(key, ghosts)
+	p.trimGhosts()
+
+	return key, true
+}
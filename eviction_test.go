@@ -0,0 +1,141 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+
+	p := NewLRU[string](0)
+	p.Added("one")
+	p.Added("two")
+	p.Added("three")
+	p.Accessed("one")
+	p.Removed("three")
+
+	key, ok := p.Evict()
+	assert.True(t, ok)
+	assert.Equal(t, "two", key)
+
+	key, ok = p.Evict()
+	assert.True(t, ok)
+	assert.Equal(t, "one", key)
+
+	_, ok = p.Evict()
+	assert.False(t, ok)
+
+}
+
+func TestLFU(t *testing.T) {
+
+	p := NewLFU[string](0)
+	p.Added("one")
+	p.Added("two")
+	p.Added("three")
+	p.Accessed("one")
+	p.Accessed("one")
+	p.Accessed("two")
+	p.Accessed("unknown")
+
+	key, ok := p.Evict()
+	assert.True(t, ok)
+	assert.Equal(t, "three", key)
+
+	key, ok = p.Evict()
+	assert.True(t, ok)
+	assert.Equal(t, "two", key)
+
+	p.Removed("one")
+	_, ok = p.Evict()
+	assert.False(t, ok)
+
+}
+
+func TestARC(t *testing.T) {
+
+	p := NewARC[string](2)
+	p.Added("one")
+	p.Added("two")
+	p.Accessed("one")
+
+	// two was only seen once, so it goes first
+	key, ok := p.Evict()
+	assert.True(t, ok)
+	assert.Equal(t, "two", key)
+
+	// adding an evicted key again promotes it to the frequent list
+	p.Added("two")
+	p.Added("three")
+
+	key, ok = p.Evict()
+	assert.True(t, ok)
+	assert.Equal(t, "one", key)
+
+	p.Removed("two")
+	p.Removed("three")
+	_, ok = p.Evict()
+	assert.False(t, ok)
+
+}
+
+func TestARC_ScanResistance(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(10))
+	h.SetEvictionPolicy(NewARC[string])
+
+	for i := 0; i < 5; i++ {
+		h.Set("hot"+strconv.Itoa(i), i)
+		h.Get("hot" + strconv.Itoa(i))
+	}
+
+	// a scan of keys used only once must not push out the hot keys
+	for i := 0; i < 100; i++ {
+		h.Set("scan"+strconv.Itoa(i), i)
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, h.Has("hot"+strconv.Itoa(i)))
+	}
+	assert.Equal(t, 10, h.len())
+
+}
+
+func TestLFU_Overwrite(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(3)).SetEvictionPolicy(NewLFU[string])
+
+	// a key updated often is used often
+	for i := 0; i < 5; i++ {
+		h.Set("hot", i)
+	}
+	h.Set("one", 1)
+	h.Get("one")
+	h.Set("two", 2)
+	h.Get("two")
+
+	h.Set("three", 3)
+	assert.True(t, h.Has("hot"))
+	assert.Equal(t, 4, h.Get("hot"))
+	assert.Equal(t, 3, h.len())
+
+}
+
+func TestARC_Overwrite(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(3)).SetEvictionPolicy(NewARC[string])
+
+	// overwriting a key promotes it to the frequent list, so a scan of keys
+	// used only once does not push it out
+	h.Set("hot", 1)
+	h.Set("hot", 2)
+
+	for i := 0; i < 10; i++ {
+		h.Set("scan"+strconv.Itoa(i), i)
+	}
+
+	assert.Equal(t, 2, h.Get("hot"))
+	assert.Equal(t, 3, h.len())
+
+}
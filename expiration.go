@@ -16,6 +16,15 @@ var ExpiresNever *Expiration = &Expiration{}
 var ExpiresDefault *Expiration = nil
 
 // Expiration describes when an object will expire.
+//
+// An Expiration is a policy which may be shared by any number of objects, and
+// is never modified once it has been made: every method building a policy
+// returns a new Expiration, leaving the one it is called on as it was. The
+// point in time at which an object expires is kept with the object.
+//
+// In earlier versions the methods changed the Expiration they were called
+// on. Code calling them for that, ignoring what they return, now makes a
+// policy which never expires, and must use the returned Expiration instead.
 type Expiration struct {
 	// idle is the sliding window duration for expiration.
 	idle time.Duration
@@ -26,13 +35,21 @@ type Expiration struct {
 	// date is an specific point in time to expire at
 	date time.Time
 
-	// absolute is the absolute point in time, used for fast comparasion.
-	// its the earliest resulting time from idle, duration or date.
-	absolute time.Time
-
 	// condition is a function provided by the creator which is called to
 	// determine if an object is expired.
 	condition ExpirationCondition
+
+	// stale is how long an object is kept and served after idle, duration
+	// or date have passed, while it is being refreshed.
+	stale time.Duration
+
+	// refreshAhead is the window before the absolute time in which an
+	// object that is accessed is refreshed by the flush manager.
+	refreshAhead time.Duration
+
+	// staleIfError is how long an object is kept after it has expired by
+	// time, to be served if loading it again fails.
+	staleIfError time.Duration
 }
 
 // Expires creates a new empty Expiration object.
@@ -44,49 +61,103 @@ func Expires() *Expiration {
 	return new(Expiration)
 }
 
-// updateAbsoluteTime sets the internal absolute field to the earliest point
-// in time resulting from idle, duration or date.
-func (e *Expiration) updateAbsoluteTime(lastAccess, created time.Time) *Expiration {
+// with returns a copy of the expiration changed by change.
+func (e *Expiration) with(change func(c *Expiration)) *Expiration {
+	c := *e
+	change(&c)
+	return &c
+}
+
+// fixedTime returns the earliest point in time resulting from duration or
+// date, which does not move when an object is accessed, or the zero time if
+// there is none.
+func (e *Expiration) fixedTime(created time.Time) time.Time {
 	abs := e.date
-	if e.idle != 0 {
-		if t := lastAccess.Add(e.idle); t.Before(abs) || abs.IsZero() {
-			abs = t
-		}
-	}
 	if e.duration != 0 {
 		if t := created.Add(e.duration); t.Before(abs) || abs.IsZero() {
 			abs = t
 		}
 	}
-	e.absolute = abs
-	return e
+	return abs
 }
 
-// isExpiredAbsolute is a quicker variant of IsExpired, but only works if the internal absolute time has been set,
-// i.e. updateAbsoluteTime() must have been called on it before
-func (e *Expiration) isExpiredAbsolute(currentTime time.Time) bool {
+// withIdle returns the earlier of fixed and the point in time resulting from
+// idle, or the zero time if there is neither.
+func (e *Expiration) withIdle(fixed, lastAccess time.Time) time.Time {
+	if e.idle != 0 {
+		if t := lastAccess.Add(e.idle); t.Before(fixed) || fixed.IsZero() {
+			return t
+		}
+	}
+	return fixed
+}
 
-	if !e.absolute.IsZero() && currentTime.After(e.absolute) {
-		return true
+// absoluteTime returns the earliest point in time resulting from idle,
+// duration or date, or the zero time if there is none.
+func (e *Expiration) absoluteTime(lastAccess, created time.Time) time.Time {
+	return e.withIdle(e.fixedTime(created), lastAccess)
+}
+
+// expiryTime returns the point in time at which an object with the absolute
+// time abs leaves the cache, which is abs extended by the stale period, or
+// the zero time if abs is zero.
+func (e *Expiration) expiryTime(abs time.Time) time.Time {
+	if abs.IsZero() {
+		return abs
 	}
-	if e.condition != nil && e.condition() {
-		return true
+	return abs.Add(e.stale)
+}
+
+// isExpiredByTimeAt determines if an object with the absolute time abs has
+// expired at currentTime. Stale objects are not expired yet.
+func (e *Expiration) isExpiredByTimeAt(currentTime, abs time.Time) bool {
+	expiry := e.expiryTime(abs)
+	return !expiry.IsZero() && currentTime.After(expiry)
+}
+
+// isStaleAt determines if an object with the absolute time abs is past it at
+// currentTime, so that it should be refreshed.
+func (e *Expiration) isStaleAt(currentTime, abs time.Time) bool {
+	return !abs.IsZero() && currentTime.After(abs)
+}
+
+// isRetainedAt determines if an object with the absolute time abs which has
+// expired by time at currentTime is still kept to be served if loading it
+// again fails.
+func (e *Expiration) isRetainedAt(currentTime, abs time.Time) bool {
+	if e.staleIfError == 0 {
+		return false
 	}
-	return false
+	expiry := e.expiryTime(abs)
+	return !expiry.IsZero() && !currentTime.After(expiry.Add(e.staleIfError))
+}
+
+// isDueForRefreshAt determines if an object with the absolute time abs,
+// last accessed at lastAccess, should be refreshed ahead of abs at
+// currentTime, which is the case once it is within the refresh-ahead window
+// and has been accessed within it.
+func (e *Expiration) isDueForRefreshAt(currentTime, lastAccess, abs time.Time) bool {
+	if e.refreshAhead == 0 || abs.IsZero() || currentTime.After(abs) {
+		return false
+	}
+	start := abs.Add(-e.refreshAhead)
+	return !currentTime.Before(start) && !lastAccess.Before(start)
+}
+
+// isRefreshed determines if objects with this expiration are refreshed with
+// the dataGetter which loaded them, because they are served stale or
+// refreshed ahead of their expiration.
+func (e *Expiration) isRefreshed() bool {
+	return e != nil && (e.stale != 0 || e.refreshAhead != 0)
 }
 
 // IsExpired determines if an expiration object has expired due to the
 // lastAccess time, the creation time, an absolute point in time or an expiration condition.
+//
+// Objects are not expired while they are stale, until the period set with
+// StaleFor has passed as well.
 func (e *Expiration) IsExpired(lastAccess, created time.Time) bool {
-	currentTime := time.Now()
-
-	if e.duration != 0 && currentTime.Sub(created) > e.duration {
-		return true
-	}
-	if e.idle != 0 && currentTime.Sub(lastAccess) > e.idle {
-		return true
-	}
-	if !e.date.IsZero() && currentTime.After(e.date) {
+	if e.isExpiredByTimeAt(time.Now(), e.absoluteTime(lastAccess, created)) {
 		return true
 	}
 	if e.condition != nil && e.condition() {
@@ -139,73 +210,84 @@ func (e *Expiration) after(duration int64, multiplier time.Duration) time.Durati
 
 // AfterSeconds expires the item after "seconds" seconds have passed.
 func (e *Expiration) AfterSeconds(seconds int64) *Expiration {
-	e.duration = e.after(seconds, time.Second)
-	return e
+	return e.with(func(c *Expiration) {
+		c.duration = e.after(seconds, time.Second)
+	})
 }
 
 // AfterMinutes expires the item after "minutes" minutes have passed.
 func (e *Expiration) AfterMinutes(minutes int64) *Expiration {
-	e.duration = e.after(minutes, time.Minute)
-	return e
+	return e.with(func(c *Expiration) {
+		c.duration = e.after(minutes, time.Minute)
+	})
 }
 
 // AfterHours expires the item after "hours" hours have passed.
 func (e *Expiration) AfterHours(hours int64) *Expiration {
-	e.duration = e.after(hours, time.Hour)
-	return e
+	return e.with(func(c *Expiration) {
+		c.duration = e.after(hours, time.Hour)
+	})
 }
 
 // AfterDays expires the item after "days" days have passed.
 func (e *Expiration) AfterDays(days int64) *Expiration {
-	e.duration = e.after(days, time.Hour*24)
-	return e
+	return e.with(func(c *Expiration) {
+		c.duration = e.after(days, time.Hour*24)
+	})
 }
 
 // AfterDuration expires the item after "duration" duration has passed.
 func (e *Expiration) AfterDuration(duration time.Duration) *Expiration {
-	e.duration = duration
-	return e
+	return e.with(func(c *Expiration) {
+		c.duration = duration
+	})
 }
 
 // AfterSecondsIdle expires the item if it hasn't been accessed for
 // "seconds" seconds.
 func (e *Expiration) AfterSecondsIdle(seconds int64) *Expiration {
-	e.idle = e.after(seconds, time.Second)
-	return e
+	return e.with(func(c *Expiration) {
+		c.idle = e.after(seconds, time.Second)
+	})
 }
 
 // AfterMinutesIdle expires the item if it hasn't been accessed for
 // "minutes" minutes.
 func (e *Expiration) AfterMinutesIdle(minutes int64) *Expiration {
-	e.idle = e.after(minutes, time.Minute)
-	return e
+	return e.with(func(c *Expiration) {
+		c.idle = e.after(minutes, time.Minute)
+	})
 }
 
 // AfterHoursIdle expires the item if it hasn't been accessed for
 // "hours" hours.
 func (e *Expiration) AfterHoursIdle(hours int64) *Expiration {
-	e.idle = e.after(hours, time.Hour)
-	return e
+	return e.with(func(c *Expiration) {
+		c.idle = e.after(hours, time.Hour)
+	})
 }
 
 // AfterDaysIdle expires the item if it hasn't been accessed for
 // "days" days.
 func (e *Expiration) AfterDaysIdle(days int64) *Expiration {
-	e.idle = e.after(days, time.Hour*24)
-	return e
+	return e.with(func(c *Expiration) {
+		c.idle = e.after(days, time.Hour*24)
+	})
 }
 
 // AfterDurationIdle expires the item if it hasn't been accessed for
 // "duration" duration.
 func (e *Expiration) AfterDurationIdle(duration time.Duration) *Expiration {
-	e.idle = duration
-	return e
+	return e.with(func(c *Expiration) {
+		c.idle = duration
+	})
 }
 
 // OnDate expires the item once "date" date has passed.
 func (e *Expiration) OnDate(date time.Time) *Expiration {
-	e.date = date
-	return e
+	return e.with(func(c *Expiration) {
+		c.date = date
+	})
 }
 
 // OnCondition expires the item if the "condition" func returns true.
@@ -214,6 +296,65 @@ func (e *Expiration) OnDate(date time.Time) *Expiration {
 // condition returns true, the item is deleted and a new item will be fetched
 // from the DataGetter.
 func (e *Expiration) OnCondition(condition ExpirationCondition) *Expiration {
-	e.condition = condition
-	return e
+	return e.with(func(c *Expiration) {
+		c.condition = condition
+	})
+}
+
+// StaleFor keeps the item for "stale" longer once it has expired by time,
+// serving it stale while it is refreshed in the background.
+//
+// While the item is stale, Get returns it immediately and calls the
+// DataGetter which loaded it in the background to replace it. Items which
+// were Set are refreshed with the DataGetter passed to Get, or from the
+// backing store. Only a single refresh runs at a time, and if it
+// fails the stale item is kept. Once the stale period has passed too, the
+// item is removed and callers wait for it to be loaded again.
+//
+// Example
+//
+//     hoard.Expires().AfterMinutes(5).StaleFor(time.Minute)
+func (e *Expiration) StaleFor(stale time.Duration) *Expiration {
+	return e.with(func(c *Expiration) {
+		c.stale = stale
+	})
+}
+
+// RefreshAhead refreshes the item in the background before it expires by
+// time, if it is accessed within "window" before then, so that items in use
+// never have to be loaded while callers wait.
+//
+// The refresh is started by the flush manager, which checks the items every
+// expiration check interval, so the window should be longer than that. The
+// item is refreshed with the DataGetter which loaded it, or from the backing
+// store. Items which were Set without a backing store are not refreshed.
+//
+// Each item is refreshed ahead at most once. If the refresh fails, the item
+// is kept until it expires as usual, rather than being retried on every
+// check.
+//
+// Example
+//
+//     hoard.Expires().AfterMinutes(5).RefreshAhead(30 * time.Second)
+func (e *Expiration) RefreshAhead(window time.Duration) *Expiration {
+	return e.with(func(c *Expiration) {
+		c.refreshAhead = window
+	})
+}
+
+// StaleIfError keeps the item for "grace" after it has expired by time, to
+// be served if loading it again fails.
+//
+// Once the item has expired, Get and its alternatives load it again as
+// usual. If the DataGetter returns an error within the grace period,
+// GetWithError returns the expired item along with a *StaleError wrapping
+// the error, instead of the zero value.
+//
+// Example
+//
+//     hoard.Expires().AfterMinutes(5).StaleIfError(time.Hour)
+func (e *Expiration) StaleIfError(grace time.Duration) *Expiration {
+	return e.with(func(c *Expiration) {
+		c.staleIfError = grace
+	})
 }
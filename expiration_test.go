@@ -26,6 +26,41 @@ func TestComplexExpires(t *testing.T) {
 
 }
 
+func TestExpiration_Immutable(t *testing.T) {
+
+	e := Expires().AfterHoursIdle(4)
+	longer := e.AfterHours(7).StaleFor(time.Minute)
+
+	assert.Equal(t, time.Duration(0), e.duration)
+	assert.Equal(t, time.Duration(0), e.stale)
+	assert.Equal(t, 7*time.Hour, longer.duration)
+	assert.Equal(t, 4*time.Hour, longer.idle)
+
+	// the shared policies are never changed either
+	never := ExpiresNever.AfterSeconds(1)
+	assert.Equal(t, time.Duration(0), ExpiresNever.duration)
+	assert.Equal(t, time.Second, never.duration)
+
+}
+
+func TestExpiration_MutatingStyle(t *testing.T) {
+
+	// policies built the way earlier versions allowed, by calling the
+	// methods for their side effects, are left empty and never expire
+	e := new(Expiration)
+	e.AfterSecondsIdle(10)
+	e.AfterSeconds(10)
+
+	long := time.Now().Add(-time.Hour)
+	assert.Equal(t, Expiration{}, *e)
+	assert.False(t, e.IsExpired(long, long))
+
+	// the returned policies have to be used instead
+	e = e.AfterSecondsIdle(10).AfterSeconds(10)
+	assert.True(t, e.IsExpired(long, long))
+
+}
+
 func TestAfterSeconds(t *testing.T) {
 
 	e := Expires().AfterSeconds(2)
@@ -123,3 +158,59 @@ func TestOnCondition(t *testing.T) {
 	assert.Equal(t, condition, e.condition)
 
 }
+
+func TestStaleFor(t *testing.T) {
+
+	e := Expires().AfterDuration(time.Minute).StaleFor(time.Hour)
+	assert.Equal(t, time.Hour, e.stale)
+
+	created := time.Now().Add(-2 * time.Minute)
+	assert.False(t, e.IsExpired(created, created))
+	assert.True(t, e.isStaleAt(time.Now(), e.absoluteTime(created, created)))
+
+	created = time.Now().Add(-2 * time.Hour)
+	assert.True(t, e.IsExpired(created, created))
+
+	// objects which never expire by time are never stale
+	e = Expires().StaleFor(time.Hour)
+	assert.False(t, e.isStaleAt(time.Now(), e.absoluteTime(created, created)))
+	assert.False(t, e.IsExpired(created, created))
+
+}
+
+func TestRefreshAhead(t *testing.T) {
+
+	e := Expires().AfterDuration(time.Minute).RefreshAhead(10 * time.Second)
+	assert.Equal(t, 10*time.Second, e.refreshAhead)
+
+	created := time.Now()
+	deadline := created.Add(time.Minute)
+
+	// not yet within the window
+	assert.False(t, e.isDueForRefreshAt(deadline.Add(-20*time.Second), created, deadline))
+
+	// within the window, but not accessed in it
+	assert.False(t, e.isDueForRefreshAt(deadline.Add(-5*time.Second), created, deadline))
+
+	// within the window, and accessed in it
+	accessed := deadline.Add(-8 * time.Second)
+	assert.True(t, e.isDueForRefreshAt(deadline.Add(-5*time.Second), accessed, deadline))
+
+	// expired already
+	assert.False(t, e.isDueForRefreshAt(deadline.Add(time.Second), accessed, deadline))
+
+}
+
+func TestStaleIfError(t *testing.T) {
+
+	e := Expires().AfterDuration(time.Minute).StaleIfError(time.Hour)
+	assert.Equal(t, time.Hour, e.staleIfError)
+
+	created := time.Now().Add(-2 * time.Minute)
+	assert.True(t, e.IsExpired(created, created))
+	assert.True(t, e.isRetainedAt(time.Now(), e.absoluteTime(created, created)))
+
+	created = time.Now().Add(-2 * time.Hour)
+	assert.False(t, e.isRetainedAt(time.Now(), e.absoluteTime(created, created)))
+
+}
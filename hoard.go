@@ -1,222 +1,450 @@
 package hoard
 
 import (
+	"context"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // container contains the cached data as well as metadata for the caching engine.
-type container struct {
+//
+// Containers are stored by pointer and never modified once they are in the
+// cache, except for the accessed field which is updated atomically. This lets
+// cache hits get by with a read lock.
+type container[V any] struct {
 
 	// data is the actual cached data.
-	data interface{}
+	data V
 
-	// accessed is the time this entry was last accessed.
-	accessed time.Time
+	// accessed is the time this entry was last accessed, in nanoseconds
+	// since the Unix epoch.
+	accessed atomic.Int64
 
 	// created is the time this entry was added to the cache
 	created time.Time
 
 	// expiration holds the expiration properties for this object.
 	expiration *Expiration
+
+	// deadline is the time this entry expires at regardless of accesses,
+	// worked out from the duration and date of its expiration when it is
+	// added, in nanoseconds since the Unix epoch, or zero if there is none.
+	// The expiration may be shared by many entries, so it is kept here.
+	deadline int64
+
+	// cost is the weight of this object against the MaxCost budget.
+	cost int64
+
+	// loader is the dataGetter which loaded the data, used to refresh it, or
+	// nil if the data was Set or its expiration does not refresh it.
+	loader TypedDataGetterWithErrorContext[V]
+
+	// err is the error cached in place of data, or nil.
+	err error
+
+	// due is when the flush manager next needs to look at this entry, in
+	// nanoseconds since the Unix epoch. It is protected by the
+	// expirationDeadbolt of the shard.
+	due int64
+
+	// slot is the position of this entry in the deadlines of the shard plus
+	// one, or zero if it is not in them. It is protected by the
+	// expirationDeadbolt of the shard.
+	slot int
+
+	// conditionSlot is the position of this entry in the conditions of the
+	// shard plus one, or zero if it is not in them. It is protected by the
+	// expirationDeadbolt of the shard.
+	conditionSlot int
 }
 
-// expirationContainer only contains the metadata for the caching engine
-type expirationContainer struct {
+// newContainer creates a new *container object, created and accessed now.
+func newContainer[V any](data V, expiration *Expiration, cost int64, now time.Time) *container[V] {
+	c := &container[V]{data: data, created: now, cost: cost}
+	c.setExpiration(expiration)
+	c.touch(now)
+	return c
+}
 
-	// accessed is the time this entry was last accessed.
-	accessed time.Time
+// setExpiration sets the expiration of this entry and works out its
+// deadline.
+func (c *container[V]) setExpiration(expiration *Expiration) {
+	c.expiration = expiration
+	c.deadline = 0
+	if expiration == nil {
+		return
+	}
+	if fixed := expiration.fixedTime(c.created); !fixed.IsZero() {
+		c.deadline = fixed.UnixNano()
+	}
+}
 
-	// created is the time this entry was added to the cache
-	created time.Time
+// absoluteTime returns the earliest point in time at which this entry
+// expires, taking into account when it was last accessed, or the zero time
+// if it does not expire by time.
+func (c *container[V]) absoluteTime() time.Time {
+	if c.expiration == nil {
+		return time.Time{}
+	}
+	var fixed time.Time
+	if c.deadline != 0 {
+		fixed = time.Unix(0, c.deadline)
+	}
+	return c.expiration.withIdle(fixed, c.lastAccessed())
+}
 
-	// expiration holds the expiration properties for this object.
-	expiration *Expiration
+// lastAccessed returns the time this entry was last accessed.
+func (c *container[V]) lastAccessed() time.Time {
+	return time.Unix(0, c.accessed.Load())
+}
+
+// touch marks this entry as accessed at the given time.
+func (c *container[V]) touch(accessed time.Time) {
+	c.accessed.Store(accessed.UnixNano())
 }
 
-// cloneExpirationContainer returns a copy of the container without the data payload
-func (c *container) cloneExpirationContainer() expirationContainer {
-	return expirationContainer{
-		accessed:   c.accessed,
-		created:    c.created,
-		expiration: c.expiration,
+// expiredAt returns whether this entry is expired at currentTime, and why.
+func (c *container[V]) expiredAt(currentTime time.Time) (RemovalReason, bool) {
+	if c.expiration == nil {
+		return 0, false
 	}
+	if c.expiration.isExpiredByTimeAt(currentTime, c.absoluteTime()) {
+		return ExpiredByTime, true
+	}
+	if c.expiration.IsExpiredByCondition() {
+		return ExpiredByCondition, true
+	}
+	return 0, false
+}
+
+// removableAt returns whether this entry should be removed from the cache at
+// currentTime, and why. Entries which have expired by time are kept while
+// they may be served if loading them again fails.
+func (c *container[V]) removableAt(currentTime time.Time) (RemovalReason, bool) {
+	reason, expired := c.expiredAt(currentTime)
+	if expired && reason == ExpiredByTime && c.err == nil && c.expiration.isRetainedAt(currentTime, c.absoluteTime()) {
+		return 0, false
+	}
+	return reason, expired
+}
+
+// staleAt returns whether this entry is stale at currentTime, so that it
+// should be refreshed.
+func (c *container[V]) staleAt(currentTime time.Time) bool {
+	return c.expiration != nil && c.expiration.isStaleAt(currentTime, c.absoluteTime())
 }
 
-// Hoard is the object through which all caching happens.
+// dueForRefreshAt returns whether this entry should be refreshed ahead of
+// its expiration at currentTime.
+func (c *container[V]) dueForRefreshAt(currentTime time.Time) bool {
+	return c.err == nil && c.expiration != nil && c.expiration.isDueForRefreshAt(currentTime, c.lastAccessed(), c.absoluteTime())
+}
+
+// expirable returns whether this entry needs to be checked by the flush
+// manager.
+func (c *container[V]) expirable() bool {
+	return c.expiration != nil && c.expiration != ExpiresNever
+}
+
+// TypedHoard is the object through which all caching happens.
 //
-// Hoard manages caching data by key, as well as managing the expiration
-// of said data based on the expiration policy you provide.
+// TypedHoard manages caching data of type V by keys of type K, as well as
+// managing the expiration of said data based on the expiration policy you
+// provide. Because both the keys and the values are typed, no type assertions
+// are needed when retrieving data.
 //
 // The flushing system will be started on demand, and will be terminated when
 // there is no more work to do.
-type Hoard struct {
-	// cache is a map containing the container objects.
-	cache map[string]container
+type TypedHoard[K comparable, V any] struct {
+	// shards hold the objects, partitioned by the hash of their keys.
+	shards []*shard[K, V]
 
-	// expirationCache is a map containing container objects.
-	expirationCache map[string]expirationContainer
+	// seed is used to hash the keys to their shard.
+	seed maphash.Seed
 
 	// defaultExpiration is an expiration object applied to all objects that
 	// do not explicitly provide an expiration.
 	defaultExpiration *Expiration
 
-	// ticker controls how often the flush check is run.
-	ticker *time.Ticker
+	// clock tells the time.
+	clock Clock
 
 	// tickerRunning stores whether the ticker is running or not.
 	tickerRunning bool
 
-	// cacheDeadbolt is used to lock the cache object.
-	cacheDeadbolt sync.RWMutex
+	// tickerRunningDeadbolt is used to lock tickerRunning.
+	tickerRunningDeadbolt sync.Mutex
 
-	// expirationDeadbolt is used to lock the expirationCache object.
-	expirationDeadbolt sync.RWMutex
+	// stop is closed to stop the flush manager when the hoard is closed.
+	stop chan struct{}
 
-	// tickerRunningDeadbolt is used to lock the ticker object.
-	tickerRunningDeadbolt sync.Mutex
+	// flushManager waits for the flush manager to stop.
+	flushManager sync.WaitGroup
+
+	// manualSweep is whether the flush manager is disabled, leaving the
+	// expired objects to Sweep and Set.
+	manualSweep bool
 
-	// keyDeadbolts hold a mutex for each key to provide thread safety for
-	// multiple thread access and reentrant calls
-	keyDeadbolts map[string]*sync.Mutex
+	// sweepKeys is the maximum number of objects looked at by a sweep, or
+	// zero if there is no limit.
+	sweepKeys int
 
-	// keyDeadbolt provides thread safety for the keyDeadbolts map
-	keyDeadbolt sync.Mutex
+	// sweepDuration is the maximum time spent by a sweep, or zero if there
+	// is no limit.
+	sweepDuration time.Duration
+
+	// sweepStart is the number of sweeps started, which picks the shard the
+	// next sweep starts with.
+	sweepStart atomic.Uint64
+
+	// flushSweeping is whether the flush manager is sweeping, and so may be
+	// calling the OnEvict and OnRemove callbacks.
+	flushSweeping atomic.Bool
+
+	// closed is whether the hoard has been closed. It is only set while
+	// the tickerRunningDeadbolt is held, so that the flush manager is not
+	// started afterwards.
+	closed atomic.Bool
 
 	// interval between expiration checks performed by startFlushManager()
 	expirationCheckInterval time.Duration
-}
 
-// startFlushManager starts the ticker to check for expired objects and
-// flushes those that are expired.
-func (h *Hoard) startFlushManager() {
+	// coster computes the cost of objects stored without an explicit cost.
+	coster Coster[V]
+
+	// onEvict is called when objects expire or are evicted.
+	onEvict RemovalCallback[K, V]
 
-	if !h.getTickerRunning() {
-		h.setTickerRunning(true)
+	// onRemove is called when objects leave the cache for any reason.
+	onRemove RemovalCallback[K, V]
 
-		h.ticker = time.NewTicker(h.expirationCheckInterval)
+	// codec encodes keys and data in snapshots.
+	codec Codec
 
-		go func() {
-			for currentTime := range h.ticker.C {
-				var expirations []string
+	// log records the changes made to the objects of a durable hoard, or is
+	// nil.
+	log *wal[K, V]
 
-				if len(h.expirationCache) != 0 {
+	// store is the backing store of the hoard, or nil.
+	store Store[K, V]
 
-					h.expirationDeadbolt.RLock()
+	// writeBehind queues the changes to the store, or is nil if they are
+	// written through.
+	writeBehind *writeBehind[K, V]
 
-					for key, value := range h.expirationCache {
+	// onStoreError is called when changes fail to be written to the store.
+	onStoreError func(key K, err error)
+}
+
+// Hoard is the untyped hoard, storing any kind of data by string keys.
+//
+// Hoard is a thin alias of TypedHoard, so all of its methods are available.
+// Data retrieved from a Hoard must be type asserted by the caller.
+type Hoard = TypedHoard[string, interface{}]
+
+// startFlushManager starts the ticker to check for expired objects and
+// flushes those that are expired.
+//
+// The flush manager stops once there are no more expirable objects, or when
+// the hoard is closed. It is not started for closed hoards, nor for hoards
+// made with the ManualSweep option.
+func (h *TypedHoard[K, V]) startFlushManager() {
 
-						if value.expiration != nil {
-							if value.expiration.isExpiredAbsolute(currentTime) {
-								expirations = append(expirations, key)
-							}
-						}
-					}
+	h.tickerRunningDeadbolt.Lock()
+	defer h.tickerRunningDeadbolt.Unlock()
 
-					h.expirationDeadbolt.RUnlock()
+	if h.tickerRunning || h.closed.Load() || h.manualSweep {
+		return
+	}
+	h.tickerRunning = true
 
-					if len(expirations) != 0 {
+	ticker := h.clock.NewTicker(h.expirationCheckInterval)
+	h.flushManager.Add(1)
 
-						h.cacheDeadbolt.Lock()
-						h.expirationDeadbolt.Lock()
-						for _, key := range expirations {
-							delete(h.cache, key)
-							delete(h.expirationCache, key)
-						}
-						h.cacheDeadbolt.Unlock()
-						h.expirationDeadbolt.Unlock()
+	go func() {
+		defer h.flushManager.Done()
+		defer ticker.Stop()
 
-					}
-				} else {
-					h.ticker.Stop()
-					h.setTickerRunning(false)
+		for {
+			select {
+			case currentTime := <-ticker.C():
+				if h.stopWhenIdle() {
+					return
 				}
+				h.flushSweeping.Store(true)
+				h.Sweep(currentTime)
+				h.flushSweeping.Store(false)
+			case <-h.stop:
+				return
 			}
-		}()
-	}
+		}
+	}()
 }
 
-// expireInternal removes the item with the specified key from the expiration cache.
-func (h *Hoard) expireInternal(key string) {
-	h.expirationDeadbolt.Lock()
-	delete(h.expirationCache, key)
-	h.expirationDeadbolt.Unlock()
+// shard returns the shard holding the key.
+func (h *TypedHoard[K, V]) shard(key K) *shard[K, V] {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	return h.shards[maphash.Comparable(h.seed, key)%uint64(len(h.shards))]
 }
 
 // cacheGet retrieves an object from the cache atomically.
-func (h *Hoard) cacheGet(key string) (container, bool) {
-	h.cacheDeadbolt.RLock()
-	object, ok := h.cache[key]
-	h.cacheDeadbolt.RUnlock()
-	return object, ok
+func (h *TypedHoard[K, V]) cacheGet(key K) (*container[V], bool) {
+	return h.shard(key).cacheGet(key)
 }
 
-// cacheSet sets an object in the cache atomically.
-func (h *Hoard) cacheSet(key string, object container) {
-	h.cacheDeadbolt.Lock()
-	h.cache[key] = object
-	h.cacheDeadbolt.Unlock()
-
+// expirationCacheLen retrieves the number of expirable objects atomically.
+func (h *TypedHoard[K, V]) expirationCacheLen() int {
+	length := 0
+	for _, s := range h.shards {
+		length += s.expirationCacheLen()
+	}
+	return length
 }
 
-// expirationCacheSet sets an object in the expirationCache atomically.
-func (h *Hoard) expirationCacheSet(key string, object container) {
+// len retrieves the number of objects atomically.
+func (h *TypedHoard[K, V]) len() int {
+	length := 0
+	for _, s := range h.shards {
+		length += s.cacheLen()
+	}
+	return length
+}
 
-	// get expiratíonConatiner without data payload
-	expirationContainer := object.cloneExpirationContainer()
+// stopWhenIdle marks the flush manager as stopped if there are no expirable
+// objects, returning whether it should stop. Objects are added before the
+// flush manager is started, so checking while holding the
+// tickerRunningDeadbolt makes sure none are left without one.
+func (h *TypedHoard[K, V]) stopWhenIdle() bool {
+	h.tickerRunningDeadbolt.Lock()
+	defer h.tickerRunningDeadbolt.Unlock()
+	if h.expirationCacheLen() != 0 {
+		return false
+	}
+	h.tickerRunning = false
+	return true
+}
 
-	// make sure the expiration has set its absolute time correctly.
-	// Because expiration is a pointer to an expiration shared with the object in normal cache, both will be updated
-	expirationContainer.expiration.updateAbsoluteTime(object.accessed, object.created)
+// Coster is a type for the function signature used to compute the cost of an
+// object of type V, such as its size in bytes.
+type Coster[V any] func(data V) int64
 
-	h.expirationDeadbolt.Lock()
-	h.expirationCache[key] = expirationContainer
-	h.expirationDeadbolt.Unlock()
+// TypedDataGetter is a type for the function signature used to place data of
+// type V into the caching system from the "Get" method.
+type TypedDataGetter[V any] func() (V, *Expiration)
 
-}
+// TypedDataGetterWithError is a type for the function signature used to place
+// data of type V into the caching system (and handling an error) from the
+// "GetWithError" method.
+type TypedDataGetterWithError[V any] func() (V, error, *Expiration)
 
-// getTickerRunning retrieves the ticker running status atomically.
-func (h *Hoard) getTickerRunning() bool {
-	h.tickerRunningDeadbolt.Lock()
-	tickerRunning := h.tickerRunning
-	h.tickerRunningDeadbolt.Unlock()
-	return tickerRunning
-}
+// TypedDataGetterContext is a type for the function signature used to place
+// data of type V into the caching system from the "GetContext" method.
+type TypedDataGetterContext[V any] func(ctx context.Context) (V, *Expiration)
 
-// setTickerRunning retrieves the ticker running status atomically.
-func (h *Hoard) setTickerRunning(tickerRunning bool) {
-	h.tickerRunningDeadbolt.Lock()
-	h.tickerRunning = tickerRunning
-	h.tickerRunningDeadbolt.Unlock()
-}
+// TypedDataGetterWithErrorContext is a type for the function signature used to
+// place data of type V into the caching system (and handling an error) from
+// the "GetWithErrorContext" method.
+type TypedDataGetterWithErrorContext[V any] func(ctx context.Context) (V, error, *Expiration)
 
 // DataGetter is a type for the function signature used to place data into the
 // caching system from the "Get" method.
-type DataGetter func() (interface{}, *Expiration)
+type DataGetter = TypedDataGetter[interface{}]
 
 // DataGetterWithError is a type for the function signature used to place data
 // into the caching system (and handling an error) from the "Get" method.
-type DataGetterWithError func() (interface{}, error, *Expiration)
+type DataGetterWithError = TypedDataGetterWithError[interface{}]
 
-// Make creates a new *Hoard object. This function must be used to create
-// a hoard object as it readies various internal fields.
+// DataGetterContext is a type for the function signature used to place data
+// into the caching system from the "GetContext" method.
+type DataGetterContext = TypedDataGetterContext[interface{}]
+
+// DataGetterWithErrorContext is a type for the function signature used to
+// place data into the caching system (and handling an error) from the
+// "GetWithErrorContext" method.
+type DataGetterWithErrorContext = TypedDataGetterWithErrorContext[interface{}]
+
+// MakeTyped creates a new *TypedHoard object. This function must be used to
+// create a typed hoard object as it readies various internal fields.
 //
-// If a Hoard object is created using new(), it will panic as soon as you
-// attempt to use it.
-func Make(defaultExpiration *Expiration) *Hoard {
+// Example
+//
+//     users := hoard.MakeTyped[int, *User](hoard.Expires().AfterMinutes(5))
+func MakeTyped[K comparable, V any](defaultExpiration *Expiration, opts ...Option) *TypedHoard[K, V] {
+
+	o := makeOptions(opts)
+	h := new(TypedHoard[K, V])
+
+	shards := o.shards
+	if shards <= 0 {
+		shards = DefaultShards
+		if o.maxEntries > 0 || o.maxCost > 0 {
+			// keep the limits exact unless asked otherwise
+			shards = 1
+		}
+	}
+
+	// the limits are shared out between the shards, rounding up
+	maxEntries := (o.maxEntries + shards - 1) / shards
+	maxCost := (o.maxCost + int64(shards) - 1) / int64(shards)
 
-	h := new(Hoard)
+	h.clock = o.clock
+	if h.clock == nil {
+		h.clock = systemClock{}
+	}
 
-	h.cache = make(map[string]container)
-	h.expirationCache = make(map[string]expirationContainer)
+	h.shards = make([]*shard[K, V], shards)
+	for i := range h.shards {
+		h.shards[i] = makeShard[K, V](maxEntries, maxCost, h.clock)
+	}
+
+	h.seed = maphash.MakeSeed()
+	h.stop = make(chan struct{})
+	h.manualSweep = o.manualSweep
+	h.sweepKeys = o.sweepKeys
+	h.sweepDuration = o.sweepDuration
 	h.defaultExpiration = defaultExpiration
-	h.keyDeadbolts = make(map[string]*sync.Mutex)
 	h.expirationCheckInterval = time.Second
 
+	// the policy and coster must be in place before the log is replayed
+	if o.newPolicy != nil {
+		newPolicy, ok := o.newPolicy.(func(capacity int) EvictionPolicy[K])
+		if !ok {
+			panic("hoard: WithEvictionPolicy for keys of another type than the hoard")
+		}
+		h.SetEvictionPolicy(newPolicy)
+	}
+	if o.coster != nil {
+		coster, ok := o.coster.(Coster[V])
+		if !ok {
+			panic("hoard: WithCoster for data of another type than the hoard")
+		}
+		h.SetCoster(coster)
+	}
+
+	if o.logPath != "" {
+		h.codec = o.logCodec
+		h.openLog(o.logPath)
+	}
+
 	return h
 
 }
 
+// Make creates a new *Hoard object. This function must be used to create
+// a hoard object as it readies various internal fields.
+//
+// If a Hoard object is created using new(), it will panic as soon as you
+// attempt to use it.
+//
+// Options, such as MaxEntries, may be passed to configure the hoard.
+func Make(defaultExpiration *Expiration, opts ...Option) *Hoard {
+	return MakeTyped[string, interface{}](defaultExpiration, opts...)
+}
+
 // SetExpirationCheckInterval sets the time interval to wait between checking
 // all expirable objects in the cache  and flushing expired ones.
 //
@@ -224,11 +452,45 @@ func Make(defaultExpiration *Expiration) *Hoard {
 //
 // This function will not change an already running ticker, it should therefore
 // preferably be called right after Make()
-func (h *Hoard) SetExpirationCheckInterval(d time.Duration) *Hoard {
+func (h *TypedHoard[K, V]) SetExpirationCheckInterval(d time.Duration) *TypedHoard[K, V] {
 	h.expirationCheckInterval = d
 	return h
 }
 
+// SetCoster sets the function computing the cost of objects stored without
+// an explicit cost, which includes all objects provided by a DataGetter.
+//
+// Default is a cost of one for every object.
+//
+// The cost of the objects already in the cache does not change, so with a
+// WriteAheadLog, use the WithCoster option instead to weigh the objects
+// restored from it.
+func (h *TypedHoard[K, V]) SetCoster(coster Coster[V]) *TypedHoard[K, V] {
+	h.coster = coster
+	return h
+}
+
+// SetEvictionPolicy sets the policy choosing which objects to evict once the
+// number of objects reaches the MaxEntries limit, or their cost the MaxCost
+// budget.
+//
+// Every shard of the hoard gets its own policy, created by calling
+// newPolicy with the share of MaxEntries of the shard, such as NewLFU[K].
+//
+// Default is NewLRU, which evicts the least recently used object.
+//
+// This function will not carry over the state of the previous policy, it
+// should therefore be called right after Make(). The objects already in the
+// cache, such as those restored from a WriteAheadLog, are handed to the new
+// policy as if they had just been added; use the WithEvictionPolicy option to
+// have them restored under the policy instead.
+func (h *TypedHoard[K, V]) SetEvictionPolicy(newPolicy func(capacity int) EvictionPolicy[K]) *TypedHoard[K, V] {
+	for _, s := range h.shards {
+		s.setEvictionPolicy(newPolicy(s.maxEntries))
+	}
+	return h
+}
+
 // Get retrieves data from the cache using the key provided.
 //
 // If a dataGetter func is passed as the second argument, the Get method uses
@@ -244,263 +506,302 @@ func (h *Hoard) SetExpirationCheckInterval(d time.Duration) *Hoard {
 // If your code needs to return a value and an error, use the GetWithError
 // method.
 //
-// If no dataGetter is passed and the key is not in the cache, Get returns nil.
-func (h *Hoard) Get(key string, dataGetter ...DataGetter) interface{} {
-
-	var data interface{}
-	object, ok := h.cacheGet(key)
-	expired := false
-
-	if ok {
-		// The object exists, but may be expired
-		if object.expiration != nil {
-			if object.expiration.IsExpired(object.accessed, object.created) { // need to check for expiration by time and condition, because h.expirationCheckInterval could be relatively large compared to objects expire time
-				Remove(key)
-				expired = true
-			}
+// If no dataGetter is passed and the key is not in the cache, Get loads the
+// data from the backing store set with SetStore. Without a store, or if the
+// store has no data for the key, Get returns the zero value of V (nil for a
+// Hoard).
+func (h *TypedHoard[K, V]) Get(key K, dataGetter ...TypedDataGetter[V]) V {
+
+	var getter TypedDataGetterWithErrorContext[V]
+
+	if len(dataGetter) != 0 {
+		getter = func(context.Context) (V, error, *Expiration) {
+			data, expiration := dataGetter[0]()
+			return data, nil, expiration
 		}
 	}
 
-	// Short circuit for quick retrieval
-	if ok && !expired {
-		data = object.data
-		object.accessed = time.Now()
-		h.cacheSet(key, object)
+	data, _ := h.getOrLoad(context.Background(), key, getter)
+	return data
 
-		if object.expiration != nil && object.expiration != ExpiresNever {
-			h.expirationCacheSet(key, object)
-		}
+}
 
-		return data
-	}
+// GetWithError operates the same way as Get, but handles error cases.
+//
+// Please refer to the documentation for the Get method for more information on
+// usage and unsupported behavior.
+//
+// If an error is encountered, the data and error are returned directly and
+// no caching is done, unless the DataGetterWithError wraps the error with
+// CacheError.
+func (h *TypedHoard[K, V]) GetWithError(key K, dataGetterWithError ...TypedDataGetterWithError[V]) (V, error) {
+
+	var getter TypedDataGetterWithErrorContext[V]
 
-	// We need to make a deadbolt for this key if one doesn't exist
-	h.keyDeadbolt.Lock()
-	if _, keyDeadboltExists := h.keyDeadbolts[key]; !keyDeadboltExists {
-		if _, exists := h.keyDeadbolts[key]; !exists {
-			h.keyDeadbolts[key] = &sync.Mutex{}
+	if len(dataGetterWithError) != 0 {
+		getter = func(context.Context) (V, error, *Expiration) {
+			return dataGetterWithError[0]()
 		}
 	}
 
-	keyDeadbolt := h.keyDeadbolts[key]
-	h.keyDeadbolt.Unlock()
+	return h.getOrLoad(context.Background(), key, getter)
 
-	// defer the unlock to account for early exits.
-	defer func() {
-		keyDeadbolt.Unlock()
-
-		// delete key specific deadbolt to avoid mutexes piling up
-		h.keyDeadbolt.Lock()
-		delete(h.keyDeadbolts, key)
-		h.keyDeadbolt.Unlock()
-	}()
-
-	// We need to lock this section to prevent multiple threads from calling
-	// the getter method more than once
-	keyDeadbolt.Lock()
-
-	// Now we need to make sure that the data we are seeking wasn't retrieved
-	// by another thread, and that it hasn't been expired in that time
+}
 
-	object, ok = h.cacheGet(key)
-	if ok {
-		// The object exists, but may be expired
-		if object.expiration != nil {
-			if object.expiration.IsExpired(object.accessed, object.created) { // need to check for expiration by time and condition, because h.expirationCheckInterval could be relatively large compared to objects expire time
-				Remove(key)
-				ok = false
-			}
+// GetContext operates the same way as Get, but passes ctx on to the
+// dataGetter and stops waiting for the data once ctx is done.
+//
+// Only one dataGetter runs for a key at a time, and every caller asking for
+// that key waits for its result. A caller whose ctx is done gives up with
+// ctx.Err() without affecting the other callers. The context passed to the
+// dataGetter carries the values of ctx, but it is only cancelled once every
+// caller waiting for the data has given up.
+func (h *TypedHoard[K, V]) GetContext(ctx context.Context, key K, dataGetter ...TypedDataGetterContext[V]) (V, error) {
+
+	var getter TypedDataGetterWithErrorContext[V]
+
+	if len(dataGetter) != 0 {
+		getter = func(ctx context.Context) (V, error, *Expiration) {
+			data, expiration := dataGetter[0](ctx)
+			return data, nil, expiration
 		}
 	}
 
-	if !ok {
-
-		if len(dataGetter) == 0 {
-			// The object wasn't in cache and there is no dataGetter
-			return nil
-		}
-
-		var expiration *Expiration
+	return h.getOrLoad(ctx, key, getter)
 
-		data, expiration = dataGetter[0]()
+}
 
-		if expiration == ExpiresDefault {
-			expiration = h.defaultExpiration
-		}
+// GetWithErrorContext operates the same way as GetWithError, but passes ctx
+// on to the dataGetterWithError and stops waiting for the data once ctx is
+// done.
+//
+// Please refer to the documentation for the GetContext method for more
+// information on how cancellation is handled.
+func (h *TypedHoard[K, V]) GetWithErrorContext(ctx context.Context, key K, dataGetterWithError ...TypedDataGetterWithErrorContext[V]) (V, error) {
 
-		h.Set(key, data, expiration)
+	var getter TypedDataGetterWithErrorContext[V]
 
-	} else {
-		data = object.data
+	if len(dataGetterWithError) != 0 {
+		getter = dataGetterWithError[0]
 	}
 
-	return data
+	return h.getOrLoad(ctx, key, getter)
 
 }
 
-// GetWithError operates the same way as Get, but handles error cases.
+// Set stores an object in cache for the given key.
 //
-// Please refer to the documentation for the Get method for more information on
-// usage and unsupported behavior.
+// The third argument, expiration, is optional. If it is not provided, the
+// default expiration policy for this instance will be used.
 //
-// If an error is encountered, the data and error are returned directly and
-// no caching is done.
-func (h *Hoard) GetWithError(key string, dataGetterWithError ...DataGetterWithError) (interface{}, error) {
+// The cost of the object is computed by the Coster set with SetCoster, use
+// SetWithCost to provide it explicitly.
+func (h *TypedHoard[K, V]) Set(key K, object V, expiration ...*Expiration) {
+	h.SetWithCost(key, object, h.cost(object), expiration...)
+}
 
-	var data interface{}
-	object, ok := h.cacheGet(key)
-	expired := false
+// SetWithCost stores an object in cache for the given key, weighing cost
+// against the MaxCost budget of the hoard.
+//
+// If the cost exceeds the budget on its own, the object is not stored and any
+// object previously stored for the key is removed.
+//
+// With a backing store, the object is written through to the store first,
+// and not cached if that fails.
+func (h *TypedHoard[K, V]) SetWithCost(key K, object V, cost int64, expiration ...*Expiration) {
+	if err := h.set(key, object, cost, expiration...); err != nil {
+		h.storeFailed(key, err)
+	}
+}
 
-	if ok {
-		// The object exists, but may be expired
-		if object.expiration != nil {
-			if object.expiration.IsExpired(object.accessed, object.created) { // need to check for expiration by time and condition, because h.expirationCheckInterval could be relatively large compared to objects expire time
-				Remove(key)
-				expired = true
-			}
-		}
+// set writes an object through to the backing store, if there is one, and
+// stores it in the cache unless that fails. The shard of the key is locked
+// across both, so that concurrent changes to the key leave the store and the
+// cache agreeing.
+func (h *TypedHoard[K, V]) set(key K, data V, cost int64, expiration ...*Expiration) error {
+	if h.closed.Load() {
+		return ErrClosed
 	}
 
-	// Short circuit for quick retrieval
-	if ok && !expired {
-		data = object.data
-		object.accessed = time.Now()
-		h.cacheSet(key, object)
+	s := h.shard(key)
+	object := h.newContainer(data, cost, expiration...)
 
-		if object.expiration != nil && object.expiration != ExpiresNever {
-			h.expirationCacheSet(key, object)
-		}
-		return data, nil
+	unlock := h.lockStore(s)
+	if err := h.save(key, data); err != nil {
+		unlock()
+		return err
 	}
+	added, removals := s.cacheAdd(key, object)
+	unlock()
 
-	// We need to make a deadbolt for this key if one doesn't exist
-	h.keyDeadbolt.Lock()
-	if _, keyDeadboltExists := h.keyDeadbolts[key]; !keyDeadboltExists {
-		if _, exists := h.keyDeadbolts[key]; !exists {
-			h.keyDeadbolts[key] = &sync.Mutex{}
-		}
+	h.added(s, object, added, removals)
+	return nil
+}
+
+// add stores an object in the cache, without writing it to the backing store.
+func (h *TypedHoard[K, V]) add(key K, object V, cost int64, expiration ...*Expiration) {
+	h.addContainer(key, h.newContainer(object, cost, expiration...))
+}
+
+// newContainer creates a container for an object, expiring with the default
+// expiration policy if none is given.
+func (h *TypedHoard[K, V]) newContainer(object V, cost int64, expiration ...*Expiration) *container[V] {
+	var exp *Expiration
+
+	if len(expiration) == 0 {
+		exp = h.defaultExpiration
+	} else {
+		exp = expiration[0]
 	}
-	keyDeadbolt := h.keyDeadbolts[key]
-	h.keyDeadbolt.Unlock()
 
-	// defer the unlock to account for early exits.
-	defer func() {
-		keyDeadbolt.Unlock()
+	return newContainer(object, exp, cost, h.clock.Now())
+}
 
-		// delete key specific deadbolt to avoid mutexes piling up
-		h.keyDeadbolt.Lock()
-		delete(h.keyDeadbolts, key)
-		h.keyDeadbolt.Unlock()
-	}()
+// addContainer stores an object in the cache, starting the flush manager if
+// it may expire.
+func (h *TypedHoard[K, V]) addContainer(key K, object *container[V]) {
+	s := h.shard(key)
+	added, removals := s.cacheAdd(key, object)
+	h.added(s, object, added, removals)
+}
 
-	// We need to lock this section to prevent multiple threads from calling
-	// the getter method more than once
-	keyDeadbolt.Lock()
+// added finishes storing an object in a shard, once no locks are held: it
+// calls the callbacks of the objects it removed, and sweeps the shard or
+// starts the flush manager.
+func (h *TypedHoard[K, V]) added(s *shard[K, V], object *container[V], added bool, removals []removal[K, V]) {
+	h.removed(removals)
 
-	// Now we need to make sure that the data we are seeking wasn't retrieved
-	// by another thread, and that it hasn't been expired in that time
+	if h.manualSweep {
+		h.sweepShardIfDue(s)
+	} else if added && object.expirable() {
+		h.startFlushManager()
+	}
+}
 
-	object, ok = h.cacheGet(key)
-	if ok {
-		// The object exists, but may be expired
-		if object.expiration != nil {
-			if object.expiration.IsExpired(object.accessed, object.created) { // need to check for expiration by time and condition, because h.expirationCheckInterval could be relatively large compared to objects expire time
-				Remove(key)
-				ok = false
-			}
-		}
+// cost computes the cost of an object using the coster, if there is one.
+func (h *TypedHoard[K, V]) cost(object V) int64 {
+	if h.coster == nil {
+		return 1
 	}
+	return h.coster(object)
+}
 
-	if !ok {
-		if len(dataGetterWithError) == 0 {
-			return nil, nil
-		}
+// TotalCost returns the total cost of the objects currently in the cache.
+func (h *TypedHoard[K, V]) TotalCost() int64 {
+	var totalCost int64
+	for _, s := range h.shards {
+		totalCost += s.getTotalCost()
+	}
+	return totalCost
+}
 
-		var expiration *Expiration
-		var err error
+// Has returns whether or not the key exists in the cache. Cached errors do
+// not count.
+func (h *TypedHoard[K, V]) Has(key K) bool {
 
-		data, err, expiration = dataGetterWithError[0]()
+	object, ok := h.cacheGet(key)
+	return ok && object.err == nil
 
-		if err != nil {
-			return data, err
-		}
+}
 
-		if expiration == ExpiresDefault {
-			expiration = h.defaultExpiration
-		}
+// Keys returns the keys of the objects in the cache, in no particular order.
+// Objects whose time has run out are left out, even if the flush manager has
+// not removed them yet, but their expiration conditions are not checked.
+// Keys with cached errors are left out too.
+func (h *TypedHoard[K, V]) Keys() []K {
 
-		h.Set(key, data, expiration)
+	now := h.clock.Now()
+	keys := make([]K, 0, h.len())
 
-	} else {
-		data = object.data
+	for _, s := range h.shards {
+		for key, object := range s.snapshot() {
+			if object.err != nil {
+				continue
+			}
+			if object.expiration == nil || !object.expiration.isExpiredByTimeAt(now, object.absoluteTime()) {
+				keys = append(keys, key)
+			}
+		}
 	}
 
-	return data, nil
+	return keys
 
 }
 
-// Set stores an object in cache for the given key.
+// ExpiresAt returns the point in time at which the object of the specified
+// key expires, as things stand, and whether the key exists in the cache. The
+// time is zero if the object does not expire by time.
 //
-// The third argument, expiration, is optional. If it is not provided, the
-// default expiration policy for this instance will be used.
-func (h *Hoard) Set(key string, object interface{}, expiration ...*Expiration) {
-	var exp *Expiration
+// For objects expiring after being idle, the time moves on whenever they are
+// accessed. For objects served stale, it is the end of the stale period.
+func (h *TypedHoard[K, V]) ExpiresAt(key K) (time.Time, bool) {
 
-	if len(expiration) == 0 {
-		exp = h.defaultExpiration
-	} else {
-		exp = expiration[0]
+	object, ok := h.cacheGet(key)
+	if !ok || object.err != nil {
+		return time.Time{}, false
+	}
+	if object.expiration == nil {
+		return time.Time{}, true
 	}
+	return object.expiration.expiryTime(object.absoluteTime()), true
 
-	containerObject := container{object, time.Now(), time.Now(), exp}
-	h.cacheSet(key, containerObject)
+}
 
-	if exp != nil && exp != ExpiresNever {
-		h.expirationCacheSet(key, containerObject)
-		h.startFlushManager()
+// Clear removes all objects from the cache, leaving the backing store alone.
+func (h *TypedHoard[K, V]) Clear() {
+	for _, s := range h.shards {
+		h.removed(s.clear())
 	}
 }
 
-// Has returns whether or not the key exists in the cache.
-func (h *Hoard) Has(key string) bool {
+// Remove removes an object by key from the cache, and deletes it from the
+// backing store if there is one.
+//
+// With a backing store, the object is deleted from the store first, so that
+// it cannot be read through again once it has left the cache, and it is kept
+// in the cache if that fails.
+func (h *TypedHoard[K, V]) Remove(key K) {
+	if h.closed.Load() {
+		return
+	}
 
-	_, ok := h.cacheGet(key)
-	return ok
+	s := h.shard(key)
+	unlock := h.lockStore(s)
+	if err := h.delete(key); err != nil {
+		unlock()
+		h.storeFailed(key, err)
+		return
+	}
 
-}
+	s.cacheDeadbolt.Lock()
+	object, ok := s.cacheDelete(key)
+	if ok {
+		s.stats.removals.Add(1)
+		s.log.remove(key)
+	}
+	s.cacheDeadbolt.Unlock()
+	unlock()
 
-// Remove removes an object by key from the cache.
-func (h *Hoard) Remove(key string) {
-	h.cacheDeadbolt.Lock()
-	delete(h.cache, key)
-	h.cacheDeadbolt.Unlock()
-	h.expireInternal(key)
+	if ok {
+		h.removed([]removal[K, V]{{key, object, RemovedExplicitly}})
+	}
 }
 
 // SetExpires updates the expiration policy for the object of the
 // specified key.
-func (h *Hoard) SetExpires(key string, expiration *Expiration) bool {
-
-	object, ok := h.cacheGet(key)
-	if !ok {
-		// not ok - we don't have this object
-		return false
-	}
+func (h *TypedHoard[K, V]) SetExpires(key K, expiration *Expiration) bool {
 
 	if expiration == ExpiresDefault {
 		expiration = h.defaultExpiration
 	}
 
-	// update the expiration policy
-	object.expiration = expiration
-
-	// set the object back in the cache
-	h.cacheSet(key, object)
+	if !h.shard(key).cacheSetExpiration(key, expiration) {
+		// not ok - we don't have this object
+		return false
+	}
 
-	if expiration == ExpiresNever || expiration == nil {
-		h.expireInternal(key)
-	} else {
-		h.expirationCacheSet(key, object)
+	if expiration != ExpiresNever && expiration != nil {
+		h.startFlushManager()
 	}
 
 	return true
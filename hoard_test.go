@@ -1,13 +1,32 @@
 package hoard
 
 import (
+	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
 
+// cached returns the container stored for the key, or nil.
+func cached(h *Hoard, key string) *container[interface{}] {
+	object, _ := h.cacheGet(key)
+	return object
+}
+
+// expiring returns the container stored in the expirationCache for the key,
+// or nil.
+func expiring(h *Hoard, key string) *container[interface{}] {
+	s := h.shard(key)
+	s.expirationDeadbolt.RLock()
+	defer s.expirationDeadbolt.RUnlock()
+	return s.expirationCache[key]
+}
+
 func TestHoard_Make(t *testing.T) {
 
 	h := Make(ExpiresNever)
@@ -25,6 +44,16 @@ func TestHoard_Make(t *testing.T) {
 
 }
 
+func TestHoard_MakeTyped(t *testing.T) {
+
+	h := MakeTyped[int, *testing.T](ExpiresNever)
+
+	if assert.NotNil(t, h) {
+		assert.Equal(t, h.defaultExpiration, ExpiresNever)
+	}
+
+}
+
 func TestHoard_Get(t *testing.T) {
 
 	firstCalled := false
@@ -69,6 +98,69 @@ func TestHoard_GetWithError(t *testing.T) {
 
 }
 
+func TestTypedHoard_Get(t *testing.T) {
+
+	type thing struct{ name string }
+
+	h := MakeTyped[int, *thing](ExpiresNever)
+
+	assert.Nil(t, h.Get(1))
+
+	result := h.Get(1, func() (*thing, *Expiration) {
+		return &thing{"first"}, ExpiresNever
+	})
+
+	assert.Equal(t, "first", result.name)
+	assert.Equal(t, "first", h.Get(1).name)
+
+}
+
+func TestTypedHoard_GetWithError(t *testing.T) {
+
+	h := MakeTyped[string, int](ExpiresNever)
+
+	result, err := h.GetWithError("key", func() (int, error, *Expiration) {
+		return 1, nil, ExpiresNever
+	})
+
+	assert.Equal(t, 1, result)
+	assert.Nil(t, err)
+
+	result, err = h.GetWithError("key2", func() (int, error, *Expiration) {
+		return 2, errors.New("EXTERMINATE!!!"), ExpiresNever
+	})
+
+	assert.Equal(t, 2, result)
+	assert.NotNil(t, err)
+	assert.False(t, h.Has("key2"))
+
+	result, err = h.GetWithError("key3")
+	assert.Equal(t, 0, result)
+	assert.Nil(t, err)
+
+}
+
+func TestHoard_GetContext(t *testing.T) {
+
+	h := Make(ExpiresNever)
+
+	result, err := h.GetContext(context.Background(), "key", func(ctx context.Context) (interface{}, *Expiration) {
+		return "first", ExpiresNever
+	})
+
+	assert.Equal(t, "first", result)
+	assert.Nil(t, err)
+
+	result, err = h.GetWithErrorContext(context.Background(), "key2", func(ctx context.Context) (interface{}, error, *Expiration) {
+		return "second", errors.New("EXTERMINATE!!!"), ExpiresNever
+	})
+
+	assert.Equal(t, "second", result)
+	assert.NotNil(t, err)
+	assert.False(t, h.Has("key2"))
+
+}
+
 func TestHoard_Remove(t *testing.T) {
 
 	h := Make(ExpiresNever)
@@ -84,6 +176,159 @@ func TestHoard_Remove(t *testing.T) {
 
 }
 
+func TestHoard_MaxEntries(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(2))
+
+	h.Set("one", 1)
+	h.Set("two", 2, Expires().AfterMinutes(1))
+	h.Get("one")
+	h.Set("three", 3)
+
+	assert.True(t, h.Has("one"))
+	assert.False(t, h.Has("two"))
+	assert.True(t, h.Has("three"))
+	assert.Equal(t, 2, h.len())
+	assert.Equal(t, 0, h.expirationCacheLen())
+
+	h.Remove("one")
+	h.Set("four", 4)
+	h.Set("four", 44)
+
+	assert.True(t, h.Has("three"))
+	assert.Equal(t, 44, h.Get("four"))
+
+}
+
+func TestHoard_SetEvictionPolicy(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(2)).SetEvictionPolicy(NewLFU[string])
+
+	h.Set("one", 1)
+	h.Set("two", 2)
+	h.Get("two")
+	h.Get("one")
+	h.Get("one")
+	h.Set("three", 3)
+
+	assert.True(t, h.Has("one"))
+	assert.False(t, h.Has("two"))
+	assert.True(t, h.Has("three"))
+
+}
+
+// neverEvict is an EvictionPolicy which has nothing to evict.
+type neverEvict[K comparable] struct{}
+
+func (neverEvict[K]) Added(key K)    {}
+func (neverEvict[K]) Accessed(key K) {}
+func (neverEvict[K]) Removed(key K)  {}
+func (neverEvict[K]) Evict() (K, bool) {
+	var key K
+	return key, false
+}
+
+func TestHoard_PolicyCannotEvict(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(2)).SetEvictionPolicy(func(capacity int) EvictionPolicy[string] {
+		return neverEvict[string]{}
+	})
+
+	// objects which no room can be made for are not stored
+	h.Set("one", 1)
+	h.Set("two", 2)
+	h.Set("three", 3)
+	assert.Equal(t, 2, h.len())
+	assert.False(t, h.Has("three"))
+
+	// replacing an object makes room for the new one
+	h.Set("two", 22)
+	assert.Equal(t, 22, h.Get("two"))
+	assert.Equal(t, 2, h.len())
+
+}
+
+func TestHoard_MaxCost(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxCost(100))
+
+	h.SetWithCost("one", 1, 40)
+	h.SetWithCost("two", 2, 40)
+	assert.Equal(t, int64(80), h.TotalCost())
+
+	h.Get("one")
+	h.SetWithCost("three", 3, 30)
+
+	assert.True(t, h.Has("one"))
+	assert.False(t, h.Has("two"))
+	assert.True(t, h.Has("three"))
+	assert.Equal(t, int64(70), h.TotalCost())
+
+	// objects larger than the whole budget are not stored
+	h.SetWithCost("one", 1, 101)
+	assert.False(t, h.Has("one"))
+	assert.Equal(t, int64(30), h.TotalCost())
+
+	h.Remove("three")
+	assert.Equal(t, int64(0), h.TotalCost())
+
+}
+
+func TestHoard_SetCoster(t *testing.T) {
+
+	h := MakeTyped[string, []byte](ExpiresNever, MaxCost(10)).SetCoster(func(data []byte) int64 {
+		return int64(len(data))
+	})
+
+	h.Set("one", []byte("12345"))
+	h.Get("two", func() ([]byte, *Expiration) {
+		return []byte("1234"), ExpiresNever
+	})
+	assert.Equal(t, int64(9), h.TotalCost())
+
+	h.Set("three", []byte("123"))
+	assert.False(t, h.Has("one"))
+	assert.Equal(t, int64(7), h.TotalCost())
+
+	// the default cost is one per object
+	h2 := Make(ExpiresNever)
+	h2.Set("one", 1)
+	h2.Set("two", 2)
+	h2.Set("two", 2)
+	assert.Equal(t, int64(2), h2.TotalCost())
+
+}
+
+func TestHoard_SetReplacesExpiration(t *testing.T) {
+
+	h := Make(ExpiresNever)
+
+	h.Set("key", 1, Expires().AfterMinutes(1))
+	assert.Equal(t, 1, h.expirationCacheLen())
+
+	h.Set("key", 2, ExpiresNever)
+	assert.Equal(t, 0, h.expirationCacheLen())
+
+}
+
+func TestHoard_GetTouchesInPlace(t *testing.T) {
+
+	h := Make(ExpiresNever)
+	h.Set("key", 1, Expires().AfterMinutesIdle(1))
+
+	object := cached(h, "key")
+	accessed := object.lastAccessed()
+	time.Sleep(time.Millisecond)
+
+	assert.Equal(t, 1, h.Get("key"))
+
+	// a hit only updates the access time of the stored container
+	assert.True(t, object == cached(h, "key"))
+	assert.True(t, object == expiring(h, "key"))
+	assert.True(t, object.lastAccessed().After(accessed))
+
+}
+
 func TestHoard_SetExpires(t *testing.T) {
 
 	date := time.Now()
@@ -93,7 +338,7 @@ func TestHoard_SetExpires(t *testing.T) {
 		return "first", ExpiresNever
 	})
 
-	assert.Equal(t, ExpiresNever, h.cache["key"].expiration)
+	assert.Equal(t, ExpiresNever, cached(h, "key").expiration)
 
 	h.SetExpires("key", Expires().OnDate(date))
 
@@ -104,11 +349,11 @@ func TestHoard_SetExpires(t *testing.T) {
 		}
 	}
 
-	// the expiratoin cache item should have its absolute expiration set to the date value as well
-	expirationItem := h.expirationCache["key"]
+	// the expiratoin cache item should have its absolute time set to the date value as well
+	expirationItem := expiring(h, "key")
 	if assert.NotNil(t, &expirationItem) {
 		if assert.NotNil(t, expirationItem.expiration, "Expiration should be set") {
-			assert.Equal(t, date, expirationItem.expiration.absolute)
+			assert.True(t, date.Equal(expirationItem.absoluteTime()))
 		}
 	}
 
@@ -133,13 +378,13 @@ func TestHoard_ExpirationSetting(t *testing.T) {
 	})
 
 	assert.Equal(t, result, "second")
-	assert.NotEqual(t, 0, h.cache["key2"].expiration.idle)
-	assert.NotEqual(t, 0, h.cache["key2"].expiration.duration)
+	assert.NotEqual(t, 0, cached(h, "key2").expiration.idle)
+	assert.NotEqual(t, 0, cached(h, "key2").expiration.duration)
 	assert.Condition(t, func() bool {
-		return h.cache["key2"].expiration.condition != nil
+		return cached(h, "key2").expiration.condition != nil
 	})
 	assert.Condition(t, func() bool {
-		return !h.cache["key2"].expiration.absolute.IsZero()
+		return !cached(h, "key2").absoluteTime().IsZero()
 	})
 
 }
@@ -187,6 +432,60 @@ func TestHoard_Has(t *testing.T) {
 	assert.True(t, h.Has("key"))
 }
 
+func TestHoard_Keys(t *testing.T) {
+	h := Make(ExpiresNever)
+
+	h.Set("one", 1)
+	h.Set("two", 2, Expires().AfterHours(1))
+	h.Set("expired", 3, Expires().OnDate(time.Now().Add(-time.Second)))
+
+	keys := h.Keys()
+	sort.Strings(keys)
+	assert.Equal(t, []string{"one", "two"}, keys)
+}
+
+func TestHoard_ExpiresAt(t *testing.T) {
+	h := Make(nil)
+	date := time.Now().Add(time.Hour)
+
+	h.Set("never", 1, ExpiresNever)
+	h.Set("default", 2)
+	h.Set("date", 3, Expires().OnDate(date))
+
+	expiresAt, ok := h.ExpiresAt("never")
+	assert.True(t, ok)
+	assert.True(t, expiresAt.IsZero())
+
+	expiresAt, ok = h.ExpiresAt("default")
+	assert.True(t, ok)
+	assert.True(t, expiresAt.IsZero())
+
+	expiresAt, ok = h.ExpiresAt("date")
+	assert.True(t, ok)
+	assert.True(t, expiresAt.Equal(date))
+
+	_, ok = h.ExpiresAt("missing")
+	assert.False(t, ok)
+}
+
+func TestHoard_Clear(t *testing.T) {
+	var removed []string
+	h := Make(ExpiresNever).OnRemove(func(key string, data interface{}, reason RemovalReason) {
+		assert.Equal(t, RemovedExplicitly, reason)
+		removed = append(removed, key)
+	})
+
+	h.Set("one", 1)
+	h.Set("two", 2, Expires().AfterHours(1))
+	h.Clear()
+
+	assert.Equal(t, 0, h.len())
+	assert.Equal(t, 0, h.expirationCacheLen())
+	assert.Equal(t, uint64(2), h.Stats().Removals)
+	sort.Strings(removed)
+	assert.Equal(t, []string{"one", "two"}, removed)
+}
+
 func TestHoard_OverrideDefault(t *testing.T) {
 
 	h := Make(Expires().AfterSeconds(1))
@@ -195,7 +494,7 @@ func TestHoard_OverrideDefault(t *testing.T) {
 		return "first", ExpiresNever
 	})
 
-	assert.Equal(t, ExpiresNever, h.cache["key"].expiration)
+	assert.Equal(t, ExpiresNever, cached(h, "key").expiration)
 
 	h = Make(ExpiresNever)
 
@@ -203,7 +502,7 @@ func TestHoard_OverrideDefault(t *testing.T) {
 		return "first", Expires().AfterSecondsIdle(1)
 	})
 
-	assert.Equal(t, 1, h.cache["key"].expiration.idle.Seconds())
+	assert.Equal(t, 1, cached(h, "key").expiration.idle.Seconds())
 
 }
 
@@ -215,7 +514,7 @@ func TestHoard_UseDefault(t *testing.T) {
 		return "first", ExpiresDefault
 	})
 
-	assert.Equal(t, 1, h.cache["key"].expiration.idle.Seconds())
+	assert.Equal(t, 1, cached(h, "key").expiration.idle.Seconds())
 
 	h = Make(ExpiresNever)
 
@@ -223,7 +522,7 @@ func TestHoard_UseDefault(t *testing.T) {
 		return "first", ExpiresDefault
 	})
 
-	assert.Equal(t, ExpiresNever, h.cache["key"].expiration)
+	assert.Equal(t, ExpiresNever, cached(h, "key").expiration)
 
 }
 
@@ -279,49 +578,105 @@ func TestHoard_ReEntry(t *testing.T) {
 
 }
 
-// The below functions take forever to run as they wait for expirations to tick
-// They are commented out to speed up development. They should be run before any
-// commit to ensure they still pass.
-/*
+func TestHoard_SharedExpiration(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[int, int](ExpiresNever, Shards(4), WithClock(clock), ManualSweep())
+	policy := Expires().AfterDurationIdle(300 * time.Millisecond).AfterHours(1)
+
+	for i := 0; i < 100; i++ {
+		h.Set(i, i, policy)
+	}
+
+	// the clock moves on between rounds, in which even keys are used while
+	// odd keys are left idle, and the policy is shared with objects added
+	// and swept meanwhile
+	added := 100
+	for round := 0; round < 6; round++ {
+		var wait sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for i := 0; i < 100; i += 2 {
+					h.Get(i)
+				}
+			}()
+		}
+		wait.Add(1)
+		go func(from int) {
+			defer wait.Done()
+			for i := from; i < from+20; i++ {
+				h.Set(i, i, policy)
+				h.Sweep(clock.Now())
+			}
+		}(added)
+		added += 20
+		wait.Wait()
+
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	h.Sweep(clock.Now())
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, i%2 == 0, h.Has(i), strconv.Itoa(i))
+	}
+	assert.Equal(t, 300*time.Millisecond, policy.idle)
+
+}
+
 func TestHoard_TickerStartStop(t *testing.T) {
 
-	h := Make(ExpiresNever)
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, string](ExpiresNever, WithClock(clock))
 
-	_ = h.Get("key", func() (interface{}, *Expiration) {
+	_ = h.Get("key", func() (string, *Expiration) {
 		return "first", ExpiresNever
 	})
 
-	assert.False(t, h.getTickerRunning())
-	assert.Equal(t, 1, len(h.cache))
+	assert.Equal(t, 0, tickers(clock))
+	assert.Equal(t, 1, h.len())
 
-	_ = h.Get("key2", func() (interface{}, *Expiration) {
+	_ = h.Get("key2", func() (string, *Expiration) {
 		return "first", Expires().AfterSeconds(1)
 	})
 
-	assert.True(t, h.getTickerRunning())
-	assert.Equal(t, 2, len(h.cache))
+	assert.Equal(t, 1, tickers(clock))
+	assert.Equal(t, 2, h.len())
 
-	time.Sleep(3 * time.Second)
-
-	assert.False(t, h.getTickerRunning())
+	clock.Advance(2 * time.Second)
+	assert.Condition(t, eventually(func() bool { return h.len() == 1 }))
+	clock.Advance(time.Second)
+	assert.Condition(t, eventually(func() bool { return tickers(clock) == 0 }))
 
-	_ = h.Get("key3", func() (interface{}, *Expiration) {
+	_ = h.Get("key3", func() (string, *Expiration) {
 		return "first", Expires().AfterSeconds(1)
 	})
-	_ = h.Get("key4", func() (interface{}, *Expiration) {
+	_ = h.Get("key4", func() (string, *Expiration) {
 		return "first", Expires().AfterSeconds(2)
 	})
 
-	assert.True(t, h.getTickerRunning())
-	assert.Equal(t, 3, len(h.cache))
+	assert.Equal(t, 1, tickers(clock))
+	assert.Equal(t, 3, h.len())
 
-	time.Sleep(4 * time.Second)
+	clock.Advance(3 * time.Second)
+	assert.Condition(t, eventually(func() bool { return h.len() == 1 }))
 
-	assert.False(t, h.getTickerRunning())
-	assert.Equal(t, 1, len(h.cache))
+	// closing stops the flush manager, whether or not it is idle
+	_ = h.Get("key5", func() (string, *Expiration) {
+		return "first", Expires().AfterSeconds(1)
+	})
+	assert.Condition(t, eventually(func() bool { return tickers(clock) == 1 }))
+	assert.NoError(t, h.Close())
+	assert.Equal(t, 0, tickers(clock))
 
 }
 
+// The below functions take forever to run as they wait for expirations to tick
+// They are commented out to speed up development. They should be run before any
+// commit to ensure they still pass.
+/*
 func TestHoard_IdleExpiration(t *testing.T) {
 
 	h := Make(ExpiresNever)
@@ -438,7 +793,7 @@ func TestHoard_ThreadSafety(t *testing.T) {
 
 	wait.Wait()
 
-	for len(h.cache) > 0 {
+	for h.len() > 0 {
 		time.Sleep(1 * time.Second)
 	}
 
@@ -452,9 +807,47 @@ func BenchmarkHoard_AddingExpiring(b *testing.B) {
 
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		_ = h.Get(string(i), func() (interface{}, *Expiration) {
+		_ = h.Get(strconv.Itoa(i), func() (interface{}, *Expiration) {
 			return 1, Expires().AfterSeconds(int64(rand.Int() % 2))
 		})
 	}
 
 }
+
+func BenchmarkHoard_GetHit(b *testing.B) {
+
+	h := Make(ExpiresNever)
+	h.Set("key", 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = h.Get("key")
+	}
+
+}
+
+func BenchmarkHoard_GetHitExpiring(b *testing.B) {
+
+	h := Make(ExpiresNever)
+	h.Set("key", 1, Expires().AfterMinutesIdle(10))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = h.Get("key")
+	}
+
+}
+
+func BenchmarkHoard_ParallelGetHitExpiring(b *testing.B) {
+
+	h := Make(ExpiresNever)
+	h.Set("key", 1, Expires().AfterMinutesIdle(10))
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = h.Get("key")
+		}
+	})
+
+}
@@ -0,0 +1,475 @@
+package hoard
+
+import (
+	"context"
+	"time"
+)
+
+// load tracks a single in-flight dataGetter call for a key, which every
+// caller asking for that key waits on.
+type load[V any] struct {
+
+	// done is closed once the dataGetter has returned.
+	done chan struct{}
+
+	// data is the data returned by the dataGetter.
+	data V
+
+	// err is the error returned by the dataGetter.
+	err error
+
+	// panicked holds the value the dataGetter panicked with, if any, so
+	// that it can be raised again for every waiting caller.
+	panicked interface{}
+
+	// waiters is the number of callers still waiting for the data.
+	waiters int
+
+	// cancel cancels the context passed to the dataGetter.
+	cancel context.CancelFunc
+
+	// background is whether the load refreshes data which is still being
+	// served, in which case errors are not cached over it.
+	background bool
+
+	// inline is whether the dataGetter is called by the caller which
+	// started the load, rather than in a goroutine of its own, in which case
+	// a panic is raised again as it is, with its stack.
+	inline bool
+}
+
+// cachedError is an error returned by a DataGetter to be cached, made by
+// CacheError.
+type cachedError struct {
+	err        error
+	expiration *Expiration
+}
+
+// Error returns the message of the error.
+func (e *cachedError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error to be cached.
+func (e *cachedError) Unwrap() error {
+	return e.err
+}
+
+// CacheError wraps an error returned by a DataGetterWithError so that the
+// error is cached for the key in place of data, with its own expiration
+// policy, which is usually short. Until it expires, Get and its alternatives
+// return the error without calling a DataGetter, so that a failing
+// downstream is not called by every request. The expiration returned by the
+// DataGetter along with the error is ignored.
+//
+// Callers are returned err itself, not the wrapper. Cached errors count as
+// ErrorHits in the statistics, are not reported to the OnEvict and OnRemove
+// callbacks and are left out of Keys, Has, snapshots and the write-ahead
+// log. They are not cached over data which is still being served, when it
+// is refreshed in the background or kept by StaleIfError.
+//
+// Example
+//
+//     users.GetWithError(id, func() (*User, error, *hoard.Expiration) {
+//         user, err := loadUser(id)
+//         if err != nil {
+//             return nil, hoard.CacheError(err, hoard.Expires().AfterSeconds(5)), nil
+//         }
+//         return user, nil, hoard.ExpiresDefault
+//     })
+func CacheError(err error, expiration *Expiration) error {
+	return &cachedError{err: err, expiration: expiration}
+}
+
+// StaleError is returned by GetWithError and its alternatives along with
+// data which has expired, when the DataGetter failed to load it again within
+// the grace period set with StaleIfError.
+//
+// Example
+//
+//     user, err := users.GetWithError(id, loadUser)
+//     var stale *hoard.StaleError
+//     if err != nil && !errors.As(err, &stale) {
+//         return nil, err
+//     }
+type StaleError struct {
+
+	// Err is the error returned by the DataGetter.
+	Err error
+
+	// Expired is the time at which the data expired.
+	Expired time.Time
+}
+
+// Error returns the message of the error.
+func (e *StaleError) Error() string {
+	return "hoard: serving data expired at " + e.Expired.Format(time.RFC3339) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the DataGetter.
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+// cacheGetFresh retrieves the object for the key if it is in the shard and
+// not expired, marking it as accessed, and whether it is stale. If the
+// object is expired, it is removed and returned as a removal for the caller
+// to report once it holds no locks.
+func (h *TypedHoard[K, V]) cacheGetFresh(s *shard[K, V], key K) (*container[V], bool, []removal[K, V]) {
+
+	object, ok := s.cacheGet(key)
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	now := h.clock.Now()
+
+	// The object exists, but may be expired
+	if reason, expired := object.expiredAt(now); expired { // need to check for expiration by time and condition, because h.expirationCheckInterval could be relatively large compared to objects expire time
+		if _, removable := object.removableAt(now); !removable {
+			// the object is kept to be served if loading it fails
+			return nil, false, nil
+		}
+		if s.cacheExpire(key, object) {
+			return nil, false, []removal[K, V]{{key, object, reason}}
+		}
+		return nil, false, nil
+	}
+
+	s.policyAccessed(key)
+
+	// stale objects are not touched, so that idle ones do not become fresh
+	// again without being refreshed
+	if object.staleAt(now) {
+		return object, true, nil
+	}
+
+	// only the access time changes on a hit, so the cache and the
+	// expirationCache do not need to be written to
+	object.touch(now)
+
+	return object, false, nil
+}
+
+// hit returns the data or cached error of an object found in the cache,
+// counting the hit, and refreshes the data in the background if it is
+// stale.
+func (h *TypedHoard[K, V]) hit(ctx context.Context, s *shard[K, V], key K, object *container[V], stale bool, dataGetter TypedDataGetterWithErrorContext[V]) (V, error) {
+
+	if object.err != nil {
+		s.stats.errorHits.Add(1)
+		var data V
+		return data, object.err
+	}
+
+	s.stats.hits.Add(1)
+	if stale {
+		h.revalidate(ctx, s, key, h.reloader(key, object, dataGetter))
+	}
+	return object.data, nil
+
+}
+
+// getOrLoad retrieves the data for the key from the cache, calling the
+// dataGetter to provide it if it is missing.
+//
+// If the key is already being loaded, getOrLoad waits for that load instead
+// of calling the dataGetter again. If the key is not in the cache, not being
+// loaded and there is no dataGetter, the zero value of V is returned.
+//
+// The dataGetter is called by the caller itself if its context cannot be
+// cancelled, as with Get, and in a goroutine otherwise, so that the caller
+// can give up waiting for it.
+//
+// Stale data is returned immediately, while it is refreshed in the
+// background. Closed hoards return ErrClosed.
+func (h *TypedHoard[K, V]) getOrLoad(ctx context.Context, key K, dataGetter TypedDataGetterWithErrorContext[V]) (V, error) {
+
+	if h.closed.Load() {
+		var data V
+		return data, ErrClosed
+	}
+
+	s := h.shard(key)
+
+	if dataGetter == nil && h.store != nil {
+		dataGetter = h.readThrough(key)
+	}
+
+	// Short circuit for quick retrieval
+	object, stale, removals := h.cacheGetFresh(s, key)
+	if object != nil {
+		return h.hit(ctx, s, key, object, stale, dataGetter)
+	}
+	h.removed(removals)
+	removals = nil
+
+	s.loadsDeadbolt.Lock()
+
+	var loadCtx context.Context
+
+	l, loading := s.loads[key]
+	if !loading {
+
+		// Now we need to make sure that the data we are seeking wasn't
+		// retrieved by another thread in the meantime. Loads are only
+		// forgotten after their data has been cached, so this check is
+		// reliable while holding the loadsDeadbolt.
+		object, stale, removals = h.cacheGetFresh(s, key)
+		if object != nil {
+			s.loadsDeadbolt.Unlock()
+			return h.hit(ctx, s, key, object, stale, dataGetter)
+		}
+
+		if dataGetter == nil {
+			s.loadsDeadbolt.Unlock()
+			h.removed(removals)
+			s.stats.misses.Add(1)
+			var data V
+			return data, nil
+		}
+
+		// The load must outlive the caller that started it, so it gets a
+		// context that keeps the caller's values but not its cancellation.
+		var cancel context.CancelFunc
+		loadCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+
+		// A caller whose context cannot be cancelled never gives up on the
+		// load, so it calls the dataGetter itself, once the loadsDeadbolt
+		// is released. Otherwise the load runs in a goroutine, so that the
+		// caller can stop waiting for it.
+		l = &load[V]{done: make(chan struct{}), cancel: cancel, inline: ctx.Done() == nil}
+		s.loads[key] = l
+
+		if !l.inline {
+			go h.runLoad(loadCtx, s, key, l, dataGetter)
+		}
+	}
+
+	l.waiters++
+	s.loadsDeadbolt.Unlock()
+
+	// objects expiring while the loadsDeadbolt was held are reported now
+	h.removed(removals)
+	s.stats.misses.Add(1)
+
+	if !loading && l.inline {
+		h.runLoad(loadCtx, s, key, l, dataGetter)
+	}
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		s.abandonLoad(key, l)
+		var data V
+		return data, ctx.Err()
+	}
+
+	if l.panicked != nil {
+		panic(l.panicked)
+	}
+
+	if l.err == errNotInStore {
+		return l.data, nil
+	}
+
+	if l.err != nil {
+		if data, expired, ok := s.cacheGetRetained(key, h.clock.Now()); ok {
+			return data, &StaleError{Err: l.err, Expired: expired}
+		}
+	}
+
+	return l.data, l.err
+
+}
+
+// revalidate refreshes stale data for the key by calling the dataGetter in
+// the background, unless the key is already being loaded, there is no
+// dataGetter or the hoard is closed. Nobody waits for the refresh, so its
+// errors are dropped and the stale data is kept.
+func (h *TypedHoard[K, V]) revalidate(ctx context.Context, s *shard[K, V], key K, dataGetter TypedDataGetterWithErrorContext[V]) {
+
+	if dataGetter == nil || h.closed.Load() {
+		return
+	}
+
+	s.loadsDeadbolt.Lock()
+	defer s.loadsDeadbolt.Unlock()
+
+	if _, loading := s.loads[key]; loading {
+		return
+	}
+
+	// the refresh outlives the caller, like any other load, and always
+	// runs in a goroutine, as the caller is served the stale data without
+	// waiting for it
+	loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	l := &load[V]{done: make(chan struct{}), cancel: cancel, background: true}
+	s.loads[key] = l
+
+	go h.runLoad(loadCtx, s, key, l, dataGetter)
+
+}
+
+// refresh refreshes the objects of the shard due to be refreshed ahead of
+// their expiration in the background, with the dataGetter which loaded them
+// or from the backing store.
+func (h *TypedHoard[K, V]) refresh(s *shard[K, V], refreshes []refresh[K, V]) {
+	for _, r := range refreshes {
+		h.revalidate(context.Background(), s, r.key, h.reloader(r.key, r.object, nil))
+	}
+}
+
+// reloader returns the dataGetter to refresh the object with: the one which
+// loaded it, otherwise the dataGetter of the caller, otherwise one reading
+// through to the backing store. It returns nil if there is none of them.
+func (h *TypedHoard[K, V]) reloader(key K, object *container[V], dataGetter TypedDataGetterWithErrorContext[V]) TypedDataGetterWithErrorContext[V] {
+	if object.loader != nil {
+		return object.loader
+	}
+	if dataGetter == nil && h.store != nil {
+		return h.readThrough(key)
+	}
+	return dataGetter
+}
+
+// runLoad calls the dataGetter for the load and caches the result, unless
+// the dataGetter returned an error or the load was abandoned.
+func (h *TypedHoard[K, V]) runLoad(ctx context.Context, s *shard[K, V], key K, l *load[V], dataGetter TypedDataGetterWithErrorContext[V]) {
+
+	started := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			l.panicked = r
+		}
+
+		s.stats.observeLoad(time.Since(started))
+		if (l.err != nil && l.err != errNotInStore) || l.panicked != nil {
+			s.stats.loadErrors.Add(1)
+		}
+
+		s.loadsDeadbolt.Lock()
+		if s.loads[key] == l {
+			delete(s.loads, key)
+		}
+		s.loadsDeadbolt.Unlock()
+
+		l.cancel()
+		close(l.done)
+
+		if l.inline && l.panicked != nil {
+			panic(l.panicked)
+		}
+	}()
+
+	var expiration *Expiration
+	l.data, l.err, expiration = dataGetter(ctx)
+
+	if cached, ok := l.err.(*cachedError); ok {
+		l.err = cached.err
+		if ctx.Err() == nil && !l.background {
+			h.cacheError(s, key, cached)
+		}
+		return
+	}
+
+	// nobody is waiting for abandoned loads anymore, and a newer load may
+	// already be running, so their data is not cached.
+	if l.err != nil || ctx.Err() != nil {
+		return
+	}
+
+	if expiration == ExpiresDefault {
+		expiration = h.defaultExpiration
+	}
+
+	// the data came from the dataGetter, so it is not written to the store.
+	// The dataGetter is only kept if it is needed to refresh the data, as
+	// whatever it holds on to stays in memory along with it.
+	object := newContainer(l.data, expiration, h.cost(l.data), h.clock.Now())
+	if expiration.isRefreshed() {
+		object.loader = dataGetter
+	}
+	h.addContainer(key, object)
+
+}
+
+// cacheError caches an error returned by a dataGetter for the key, unless
+// expired data is kept for the key to be served instead.
+func (h *TypedHoard[K, V]) cacheError(s *shard[K, V], key K, cached *cachedError) {
+
+	if _, _, retained := s.cacheGetRetained(key, h.clock.Now()); retained {
+		return
+	}
+
+	expiration := cached.expiration
+	if expiration == ExpiresDefault {
+		expiration = h.defaultExpiration
+	}
+
+	var data V
+	object := newContainer(data, expiration, 0, h.clock.Now())
+	object.err = cached.err
+	h.addContainer(key, object)
+
+}
+
+// cancelLoads cancels the contexts of the in-flight loads of the shard.
+func (s *shard[K, V]) cancelLoads() {
+	s.loadsDeadbolt.Lock()
+	defer s.loadsDeadbolt.Unlock()
+
+	for _, l := range s.loads {
+		l.cancel()
+	}
+}
+
+// abandonLoad stops a caller from waiting on the load. Once the last waiting
+// caller has given up, the load is cancelled and forgotten, so that the next
+// caller starts a new one.
+func (s *shard[K, V]) abandonLoad(key K, l *load[V]) {
+
+	s.loadsDeadbolt.Lock()
+	defer s.loadsDeadbolt.Unlock()
+
+	l.waiters--
+	if l.waiters == 0 {
+		l.cancel()
+		if s.loads[key] == l {
+			delete(s.loads, key)
+		}
+	}
+
+}
+
+// lookup retrieves the data for the key if it is in the cache and not
+// expired, counting the hit or miss. Stale data is refreshed with the
+// dataGetter which loaded it or from the backing store. Cached errors are
+// not found.
+func (h *TypedHoard[K, V]) lookup(key K) (V, bool) {
+
+	s := h.shard(key)
+
+	object, stale, removals := h.cacheGetFresh(s, key)
+	h.removed(removals)
+
+	switch {
+	case object == nil:
+		s.stats.misses.Add(1)
+	case object.err != nil:
+		s.stats.errorHits.Add(1)
+	default:
+		s.stats.hits.Add(1)
+		if stale {
+			h.revalidate(context.Background(), s, key, h.reloader(key, object, nil))
+		}
+		return object.data, true
+	}
+
+	var data V
+	return data, false
+
+}
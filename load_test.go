@@ -0,0 +1,528 @@
+package hoard
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoad_WaiterGivesUp(t *testing.T) {
+
+	h := Make(ExpiresNever)
+	release := make(chan struct{})
+	calls := 0
+
+	getter := func(ctx context.Context) (interface{}, *Expiration) {
+		calls++
+		<-release
+		return "loaded", ExpiresNever
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	var result interface{}
+	var err error
+	go func() {
+		result, err = h.GetContext(context.Background(), "key", getter)
+		wait.Done()
+	}()
+
+	// give the first caller time to start the load
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	impatient, impatientErr := h.GetContext(ctx, "key", getter)
+	assert.Nil(t, impatient)
+	assert.Equal(t, context.DeadlineExceeded, impatientErr)
+
+	close(release)
+	wait.Wait()
+
+	assert.Equal(t, "loaded", result)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "loaded", h.Get("key"))
+
+}
+
+func TestLoad_AllWaitersGiveUp(t *testing.T) {
+
+	h := Make(ExpiresNever)
+	cancelled := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := h.GetWithErrorContext(ctx, "key", func(ctx context.Context) (interface{}, error, *Expiration) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err(), ExpiresNever
+	})
+
+	assert.Equal(t, context.Canceled, err)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the dataGetter context should be cancelled once nobody waits for it")
+	}
+
+	assert.False(t, h.Has("key"))
+
+}
+
+func TestLoad_ContextValues(t *testing.T) {
+
+	type ctxKey struct{}
+
+	h := Make(ExpiresNever)
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+
+	result, err := h.GetContext(ctx, "key", func(ctx context.Context) (interface{}, *Expiration) {
+		return ctx.Value(ctxKey{}), ExpiresNever
+	})
+
+	assert.Equal(t, "value", result)
+	assert.Nil(t, err)
+
+}
+
+func TestLoad_WaitsForInFlightLoad(t *testing.T) {
+
+	h := Make(ExpiresNever)
+	started := make(chan struct{})
+
+	go h.Get("key", func() (interface{}, *Expiration) {
+		close(started)
+		time.Sleep(10 * time.Millisecond)
+		return "loaded", ExpiresNever
+	})
+
+	<-started
+
+	// a Get without a dataGetter still waits for the running load
+	assert.Equal(t, "loaded", h.Get("key"))
+
+}
+
+func TestLoad_RunsInline(t *testing.T) {
+
+	h := MakeTyped[string, string](ExpiresNever)
+	var stack string
+
+	// callers which cannot give up call the dataGetter themselves
+	h.Get("key", func() (string, *Expiration) {
+		stack = string(debug.Stack())
+		return "first", ExpiresDefault
+	})
+	assert.Contains(t, stack, "TestLoad_RunsInline(")
+
+	// the others wait for it to run in a goroutine of its own
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.GetContext(ctx, "other", func(ctx context.Context) (string, *Expiration) {
+		stack = string(debug.Stack())
+		return "second", ExpiresDefault
+	})
+	assert.NotContains(t, stack, "TestLoad_RunsInline(")
+	assert.Equal(t, "second", h.Get("other"))
+
+}
+
+func TestLoad_PanicsInline(t *testing.T) {
+
+	h := MakeTyped[string, string](ExpiresNever)
+
+	// the panic is raised again with the stack of the dataGetter
+	var stack string
+	func() {
+		defer func() {
+			recover()
+			stack = string(debug.Stack())
+		}()
+		h.Get("key", func() (string, *Expiration) {
+			explode()
+			return "", nil
+		})
+	}()
+	assert.Contains(t, stack, "hoard.explode(")
+
+	// the load is forgotten, so the key can be loaded again
+	assert.Equal(t, "second", h.Get("key", func() (string, *Expiration) {
+		return "second", ExpiresNever
+	}))
+
+}
+
+// explode panics, as a dataGetter going wrong.
+func explode() {
+	panic(errors.New("EXTERMINATE!!!"))
+}
+
+func TestLoad_Panics(t *testing.T) {
+
+	h := Make(ExpiresNever)
+
+	assert.Panics(t, func() {
+		h.Get("key", func() (interface{}, *Expiration) {
+			panic(errors.New("EXTERMINATE!!!"))
+		})
+	})
+
+	assert.False(t, h.Has("key"))
+	assert.Equal(t, "second", h.Get("key", func() (interface{}, *Expiration) {
+		return "second", ExpiresNever
+	}))
+
+}
+
+func TestLoad_StaleWhileRevalidate(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(20 * time.Millisecond).StaleFor(time.Hour))
+	release := make(chan struct{})
+	var calls atomic.Int32
+
+	getter := func() (int, *Expiration) {
+		call := calls.Add(1)
+		if call > 1 {
+			<-release
+		}
+		return int(call), ExpiresDefault
+	}
+
+	assert.Equal(t, 1, h.Get("key", getter))
+
+	time.Sleep(30 * time.Millisecond)
+
+	// stale data is served at once while a single refresh runs
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			assert.Equal(t, 1, h.Get("key", getter))
+		}()
+	}
+	wait.Wait()
+	assert.Condition(t, eventually(func() bool {
+		return calls.Load() == 2
+	}))
+
+	close(release)
+
+	assert.Condition(t, eventually(func() bool {
+		return h.Get("key") == 2
+	}))
+	assert.Equal(t, int32(2), calls.Load())
+
+}
+
+func TestLoad_StaleRefreshesWithLoader(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(10 * time.Millisecond).StaleFor(time.Hour))
+	var calls atomic.Int32
+
+	assert.Equal(t, 1, h.Get("key", func() (int, *Expiration) {
+		return int(calls.Add(1)), ExpiresDefault
+	}))
+
+	time.Sleep(20 * time.Millisecond)
+
+	// the stale data is refreshed with the dataGetter which loaded it, even
+	// when it is read without one
+	assert.Equal(t, 1, h.Get("key"))
+	assert.Condition(t, eventually(func() bool {
+		return h.Get("key") == 2
+	}))
+	assert.Equal(t, int32(2), calls.Load())
+
+}
+
+func TestLoad_StaleExpires(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(10 * time.Millisecond).StaleFor(10 * time.Millisecond))
+	calls := 0
+
+	getter := func() (int, *Expiration) {
+		calls++
+		return calls, ExpiresDefault
+	}
+
+	assert.Equal(t, 1, h.Get("key", getter))
+
+	time.Sleep(30 * time.Millisecond)
+
+	// once the stale period is over, callers wait for the data
+	assert.Equal(t, 2, h.Get("key", getter))
+
+}
+
+func TestLoad_StaleRefreshFails(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(10 * time.Millisecond).StaleFor(time.Hour))
+	var calls atomic.Int32
+
+	getter := func() (int, error, *Expiration) {
+		if calls.Add(1) > 1 {
+			return 0, errors.New("EXTERMINATE!!!"), nil
+		}
+		return 1, nil, ExpiresDefault
+	}
+
+	value, _ := h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+
+	time.Sleep(20 * time.Millisecond)
+
+	value, err := h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+	assert.NoError(t, err)
+
+	// the stale data is kept when the refresh fails
+	assert.Condition(t, eventually(func() bool {
+		return calls.Load() == 2 && h.Stats().LoadErrors == 1
+	}))
+	assert.True(t, h.Has("key"))
+
+}
+
+func TestLoad_RefreshAhead(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(100 * time.Millisecond).RefreshAhead(80 * time.Millisecond))
+	h.SetExpirationCheckInterval(5 * time.Millisecond)
+	var hot, cold atomic.Int32
+
+	assert.Equal(t, 1, h.Get("hot", func() (int, *Expiration) {
+		return int(hot.Add(1)), ExpiresDefault
+	}))
+	assert.Equal(t, 1, h.Get("cold", func() (int, *Expiration) {
+		return int(cold.Add(1)), ExpiresDefault
+	}))
+
+	// the hot key is refreshed with the remembered loader, so it is never
+	// missing
+	for i := 0; i < 30; i++ {
+		time.Sleep(10 * time.Millisecond)
+		assert.True(t, h.Has("hot"))
+		h.Get("hot")
+	}
+
+	assert.True(t, hot.Load() > 1)
+	assert.Equal(t, int32(1), cold.Load())
+	assert.False(t, h.Has("cold"))
+	assert.Equal(t, uint64(2), h.Stats().Misses)
+
+}
+
+func TestLoad_RefreshAheadFails(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](Expires().AfterMinutes(1).RefreshAhead(30*time.Second), WithClock(clock), ManualSweep())
+	var calls atomic.Int32
+
+	getter := func() (int, error, *Expiration) {
+		if calls.Add(1) > 1 {
+			return 0, errors.New("EXTERMINATE!!!"), nil
+		}
+		return 1, nil, ExpiresDefault
+	}
+
+	value, _ := h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+
+	clock.Advance(40 * time.Second)
+	assert.Equal(t, 1, h.Get("key"))
+
+	h.Sweep(clock.Now())
+	assert.Condition(t, eventually(func() bool {
+		return h.Stats().LoadErrors == 1
+	}))
+
+	// the failed refresh is not retried on every sweep
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+		h.Sweep(clock.Now())
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, 1, h.Get("key"))
+
+}
+
+func TestLoad_KeepsLoaderToRefresh(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterMinutes(1))
+	getter := func() (int, *Expiration) {
+		return 1, ExpiresDefault
+	}
+
+	// the dataGetter is only kept when it refreshes the data
+	h.Get("plain", getter)
+	object, _ := h.cacheGet("plain")
+	assert.Nil(t, object.loader)
+
+	h.Get("stale", func() (int, *Expiration) {
+		return 1, Expires().AfterMinutes(1).StaleFor(time.Minute)
+	})
+	object, _ = h.cacheGet("stale")
+	assert.NotNil(t, object.loader)
+
+	h.Get("ahead", func() (int, *Expiration) {
+		return 1, Expires().AfterMinutes(1).RefreshAhead(time.Second)
+	})
+	object, _ = h.cacheGet("ahead")
+	assert.NotNil(t, object.loader)
+
+}
+
+func TestLoad_StaleIfError(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(10 * time.Millisecond).StaleIfError(time.Hour))
+	h.SetExpirationCheckInterval(time.Millisecond)
+	var failure error
+
+	getter := func() (int, error, *Expiration) {
+		if failure != nil {
+			return 0, failure, nil
+		}
+		return 1, nil, ExpiresDefault
+	}
+
+	value, err := h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+	assert.NoError(t, err)
+
+	time.Sleep(30 * time.Millisecond)
+
+	// the expired data is kept rather than flushed, but not served
+	assert.True(t, h.Has("key"))
+	assert.Equal(t, 0, h.Get("key"))
+
+	failure = errors.New("EXTERMINATE!!!")
+	value, err = h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+	var stale *StaleError
+	if assert.True(t, errors.As(err, &stale)) {
+		assert.Equal(t, failure, stale.Err)
+		assert.False(t, stale.Expired.IsZero())
+	}
+	assert.True(t, errors.Is(err, failure))
+
+	// loading it successfully replaces it
+	failure = nil
+	value, err = h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+	assert.NoError(t, err)
+
+}
+
+func TestLoad_StaleIfErrorGraceOver(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(10 * time.Millisecond).StaleIfError(10 * time.Millisecond))
+	failure := errors.New("EXTERMINATE!!!")
+
+	h.Set("key", 1)
+
+	time.Sleep(30 * time.Millisecond)
+
+	value, err := h.GetWithError("key", func() (int, error, *Expiration) {
+		return 0, failure, nil
+	})
+	assert.Equal(t, 0, value)
+	assert.Equal(t, failure, err)
+
+}
+
+func TestLoad_CacheError(t *testing.T) {
+
+	h := MakeTyped[string, int](ExpiresNever)
+	failure := errors.New("EXTERMINATE!!!")
+	calls := 0
+
+	getter := func() (int, error, *Expiration) {
+		calls++
+		if calls == 1 {
+			return 0, CacheError(failure, Expires().AfterDuration(20*time.Millisecond)), nil
+		}
+		return calls, nil, ExpiresDefault
+	}
+
+	for i := 0; i < 3; i++ {
+		value, err := h.GetWithError("key", getter)
+		assert.Equal(t, 0, value)
+		assert.Equal(t, failure, err)
+	}
+	assert.Equal(t, 1, calls)
+
+	// cached errors are not data
+	assert.False(t, h.Has("key"))
+	assert.Empty(t, h.Keys())
+
+	stats := h.Stats()
+	assert.Equal(t, uint64(0), stats.Hits)
+	assert.Equal(t, uint64(2), stats.ErrorHits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.LoadErrors)
+
+	time.Sleep(30 * time.Millisecond)
+
+	value, err := h.GetWithError("key", getter)
+	assert.Equal(t, 2, value)
+	assert.NoError(t, err)
+
+}
+
+func TestLoad_CacheErrorKeepsStaleData(t *testing.T) {
+
+	h := MakeTyped[string, int](Expires().AfterDuration(10 * time.Millisecond).StaleFor(time.Hour))
+	var calls atomic.Int32
+
+	getter := func() (int, error, *Expiration) {
+		if calls.Add(1) > 1 {
+			return 0, CacheError(errors.New("EXTERMINATE!!!"), ExpiresNever), nil
+		}
+		return 1, nil, ExpiresDefault
+	}
+
+	value, _ := h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// the failed refresh does not replace the stale data
+	value, err := h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+	assert.NoError(t, err)
+	assert.Condition(t, eventually(func() bool {
+		return h.Stats().LoadErrors == 1
+	}))
+	value, err = h.GetWithError("key", getter)
+	assert.Equal(t, 1, value)
+	assert.NoError(t, err)
+
+}
+
+// eventually returns a condition waiting up to a second for the condition
+// to become true.
+func eventually(condition func() bool) func() bool {
+	return func() bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if condition() {
+				return true
+			}
+		}
+		return condition()
+	}
+}
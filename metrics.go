@@ -0,0 +1,144 @@
+package hoard
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StatsProvider is implemented by every hoard, whatever its key and value
+// types, and is used by the MetricsHandler to collect their statistics.
+type StatsProvider interface {
+	Stats() Statistics
+}
+
+// MetricsHandler is an http.Handler exposing the statistics of hoards in the
+// Prometheus text exposition format.
+//
+// Every hoard is registered under a name, which is used as the value of the
+// "cache" label of its metrics, so that any number of hoards can be exported
+// from one endpoint.
+//
+// Example
+//
+//     metrics := hoard.NewMetricsHandler()
+//     metrics.Register("users", users)
+//     metrics.Register("shared", hoard.Shared())
+//     http.Handle("/metrics", metrics)
+type MetricsHandler struct {
+
+	// hoards maps the names of the registered hoards to the hoards.
+	hoards map[string]StatsProvider
+
+	// hoardsDeadbolt provides thread safety for the hoards map.
+	hoardsDeadbolt sync.RWMutex
+}
+
+// NewMetricsHandler creates a new *MetricsHandler without any hoards.
+func NewMetricsHandler() *MetricsHandler {
+	return &MetricsHandler{hoards: make(map[string]StatsProvider)}
+}
+
+// Register adds the hoard to the handler under the given name, replacing any
+// hoard already registered with that name.
+func (m *MetricsHandler) Register(name string, hoard StatsProvider) *MetricsHandler {
+	m.hoardsDeadbolt.Lock()
+	m.hoards[name] = hoard
+	m.hoardsDeadbolt.Unlock()
+	return m
+}
+
+// Unregister removes the hoard with the given name from the handler.
+func (m *MetricsHandler) Unregister(name string) {
+	m.hoardsDeadbolt.Lock()
+	delete(m.hoards, name)
+	m.hoardsDeadbolt.Unlock()
+}
+
+// namedStatistics holds the statistics of a registered hoard.
+type namedStatistics struct {
+	name  string
+	stats Statistics
+}
+
+// collect returns the statistics of every registered hoard, ordered by name.
+func (m *MetricsHandler) collect() []namedStatistics {
+	m.hoardsDeadbolt.RLock()
+	collected := make([]namedStatistics, 0, len(m.hoards))
+	for name, hoard := range m.hoards {
+		collected = append(collected, namedStatistics{name, hoard.Stats()})
+	}
+	m.hoardsDeadbolt.RUnlock()
+
+	sort.Slice(collected, func(i, j int) bool {
+		return collected[i].name < collected[j].name
+	})
+
+	return collected
+}
+
+// counterMetrics describes the metrics that are plain counters.
+var counterMetrics = []struct {
+	name  string
+	help  string
+	value func(Statistics) uint64
+}{
+	{"hoard_hits_total", "Number of times data was found in the cache.", func(s Statistics) uint64 { return s.Hits }},
+	{"hoard_error_hits_total", "Number of times a cached error was found in the cache.", func(s Statistics) uint64 { return s.ErrorHits }},
+	{"hoard_misses_total", "Number of times data was not found in the cache.", func(s Statistics) uint64 { return s.Misses }},
+	{"hoard_loads_total", "Number of times a DataGetter was called.", func(s Statistics) uint64 { return s.Loads }},
+	{"hoard_load_errors_total", "Number of times a DataGetter returned an error or panicked.", func(s Statistics) uint64 { return s.LoadErrors }},
+	{"hoard_expirations_total", "Number of objects removed because they expired.", func(s Statistics) uint64 { return s.Expirations }},
+	{"hoard_evictions_total", "Number of objects evicted to keep the cache within its limits.", func(s Statistics) uint64 { return s.Evictions }},
+	{"hoard_removals_total", "Number of objects removed explicitly.", func(s Statistics) uint64 { return s.Removals }},
+}
+
+// ServeHTTP renders the statistics of all registered hoards.
+func (m *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	collected := m.collect()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for _, metric := range counterMetrics {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, c := range collected {
+			fmt.Fprintf(out, "%s{cache=\"%s\"} %d\n", metric.name, escapeLabel(c.name), metric.value(c.stats))
+		}
+	}
+
+	fmt.Fprint(out, "# HELP hoard_entries Number of objects in the cache.\n# TYPE hoard_entries gauge\n")
+	for _, c := range collected {
+		fmt.Fprintf(out, "hoard_entries{cache=\"%s\"} %d\n", escapeLabel(c.name), c.stats.Entries)
+	}
+
+	fmt.Fprint(out, "# HELP hoard_load_duration_seconds Time spent in DataGetters.\n# TYPE hoard_load_duration_seconds histogram\n")
+	for _, c := range collected {
+		name := escapeLabel(c.name)
+
+		// Prometheus buckets are cumulative
+		var count uint64
+		for i, bound := range LoadTimeBuckets {
+			count += c.stats.LoadTimeHistogram[i]
+			fmt.Fprintf(out, "hoard_load_duration_seconds_bucket{cache=\"%s\",le=\"%s\"} %d\n", name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), count)
+		}
+		fmt.Fprintf(out, "hoard_load_duration_seconds_bucket{cache=\"%s\",le=\"+Inf\"} %d\n", name, c.stats.Loads)
+		fmt.Fprintf(out, "hoard_load_duration_seconds_sum{cache=\"%s\"} %s\n", name, strconv.FormatFloat(c.stats.LoadTime.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(out, "hoard_load_duration_seconds_count{cache=\"%s\"} %d\n", name, c.stats.Loads)
+	}
+
+}
+
+// labelEscaper escapes the characters which are not allowed in label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,46 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+
+	users := MakeTyped[int, string](ExpiresNever)
+	users.Get(1, func() (string, *Expiration) {
+		return "one", ExpiresNever
+	})
+	users.Get(1)
+
+	pages := Make(ExpiresNever)
+	pages.Get("missing")
+
+	metrics := NewMetricsHandler().Register("users", users).Register("pa\"ges", pages)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, body, "# TYPE hoard_hits_total counter\n")
+	assert.Contains(t, body, "hoard_hits_total{cache=\"users\"} 1\n")
+	assert.Contains(t, body, "hoard_misses_total{cache=\"pa\\\"ges\"} 1\n")
+	assert.Contains(t, body, "hoard_entries{cache=\"users\"} 1\n")
+	assert.Contains(t, body, "# TYPE hoard_load_duration_seconds histogram\n")
+	assert.Contains(t, body, "hoard_load_duration_seconds_bucket{cache=\"users\",le=\"10\"} 1\n")
+	assert.Contains(t, body, "hoard_load_duration_seconds_bucket{cache=\"users\",le=\"+Inf\"} 1\n")
+	assert.Contains(t, body, "hoard_load_duration_seconds_count{cache=\"pa\\\"ges\"} 0\n")
+
+	// hoards are listed in order of their names
+	assert.True(t, strings.Index(body, "cache=\"pa") < strings.Index(body, "cache=\"users\""))
+
+	metrics.Unregister("users")
+
+	recorder = httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.NotContains(t, recorder.Body.String(), "users")
+
+}
@@ -0,0 +1,211 @@
+package hoard
+
+import (
+	"time"
+)
+
+// DefaultShards is the number of shards used by hoards made without the Shards
+// option, unless they are bounded by MaxEntries or MaxCost.
+const DefaultShards = 16
+
+// Option configures a hoard when it is made.
+//
+// Example
+//
+//     h := hoard.Make(hoard.ExpiresNever, hoard.MaxEntries(1000))
+type Option func(*options)
+
+// options holds the configuration collected from the Options passed to Make.
+type options struct {
+
+	// maxEntries is the maximum number of objects in the cache, or zero if
+	// the cache is unbounded.
+	maxEntries int
+
+	// maxCost is the maximum total cost of the objects in the cache, or zero
+	// if the cost is unbounded.
+	maxCost int64
+
+	// shards is the number of shards the objects are partitioned into, or
+	// zero for the default.
+	shards int
+
+	// logPath is the path of the write-ahead log, or empty if the hoard is
+	// not durable.
+	logPath string
+
+	// logCodec encodes the keys and data in the write-ahead log.
+	logCodec Codec
+
+	// clock tells the time, or is nil for the system clock.
+	clock Clock
+
+	// manualSweep is whether expired objects are only removed by Sweep and
+	// Set, instead of the flush manager.
+	manualSweep bool
+
+	// sweepKeys is the maximum number of objects looked at by a sweep, or
+	// zero if there is no limit.
+	sweepKeys int
+
+	// sweepDuration is the maximum time spent by a sweep, or zero if there
+	// is no limit.
+	sweepDuration time.Duration
+
+	// newPolicy creates the eviction policy of every shard, as a
+	// func(capacity int) EvictionPolicy[K], or is nil for the default.
+	newPolicy interface{}
+
+	// coster computes the cost of objects, as a Coster[V], or is nil for a
+	// cost of one.
+	coster interface{}
+}
+
+// makeOptions applies the Options to a new options object.
+func makeOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// MaxEntries limits the number of objects held by the hoard. Once the limit
+// is reached, adding an object evicts another one as chosen by the eviction
+// policy, which is least recently used unless set with SetEvictionPolicy.
+//
+// A limit of zero, the default, means the hoard is unbounded.
+func MaxEntries(n int) Option {
+	return func(o *options) {
+		o.maxEntries = n
+	}
+}
+
+// MaxCost limits the total cost of the objects held by the hoard. Once the
+// budget is exceeded, objects are evicted as chosen by the eviction policy
+// until the new object fits.
+//
+// The cost of an object is provided to SetWithCost, or computed by the Coster
+// set with SetCoster, and is one otherwise. A budget of zero, the default,
+// means the cost is unbounded.
+func MaxCost(cost int64) Option {
+	return func(o *options) {
+		o.maxCost = cost
+	}
+}
+
+// Shards sets the number of shards the objects of the hoard are partitioned
+// into by the hash of their keys. Every shard has its own locks, so threads
+// accessing keys in different shards do not wait for each other.
+//
+// The default is DefaultShards, or one shard for hoards bounded by
+// MaxEntries or MaxCost. Their limits are shared out evenly between the
+// shards and enforced for each shard separately, so with more than one shard
+// objects may be evicted before the hoard as a whole is full.
+func Shards(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// WriteAheadLog makes the hoard durable, by appending every change made to its
+// objects to the log file at path, including expirations and evictions. When
+// a hoard is made with a log that already exists, the objects recorded in it
+// are restored first, skipping those which have expired since.
+//
+// Keys and data are encoded with the codec, or GobCodec if it is nil. Every
+// record is checksummed, so that a record torn by a crash is detected and
+// discarded. The log is compacted into a snapshot at path + ".snapshot" when
+// the hoard is made, and in the background whenever it grows large.
+//
+// Changes are written to the log file without waiting for them to reach the
+// disk, so they survive the process crashing, but not the machine. Use
+// LogError to find out whether the log is working, and CloseLog to flush it
+// when the hoard is no longer used.
+func WriteAheadLog(path string, codec Codec) Option {
+	return func(o *options) {
+		o.logPath = path
+		o.logCodec = codec
+	}
+}
+
+// WithEvictionPolicy sets the policy choosing which objects to evict, as
+// SetEvictionPolicy does, before the objects of the WriteAheadLog are
+// restored, so that they are evicted by it as well.
+//
+// The keys of the policy must be of the type of the keys of the hoard, or
+// making the hoard panics.
+//
+// Example
+//
+//     h := hoard.Make(hoard.ExpiresNever, hoard.MaxEntries(1000), hoard.WithEvictionPolicy(hoard.NewLFU[string]))
+func WithEvictionPolicy[K comparable](newPolicy func(capacity int) EvictionPolicy[K]) Option {
+	return func(o *options) {
+		o.newPolicy = newPolicy
+	}
+}
+
+// WithCoster sets the function computing the cost of objects, as SetCoster
+// does, before the objects of the WriteAheadLog are restored, so that they are
+// weighed by it as well.
+//
+// The coster must take data of the type of the data of the hoard, or making
+// the hoard panics.
+//
+// Example
+//
+//     h := hoard.MakeTyped[string, []byte](hoard.ExpiresNever, hoard.MaxCost(1<<20), hoard.WithCoster(func(data []byte) int64 {
+//         return int64(len(data))
+//     }))
+func WithCoster[V any](coster Coster[V]) Option {
+	return func(o *options) {
+		o.coster = coster
+	}
+}
+
+// WithClock makes the hoard tell the time with clock instead of the system
+// clock.
+//
+// Example
+//
+//     clock := hoard.NewFakeClock(time.Now())
+//     h := hoard.Make(hoard.Expires().AfterSeconds(10), hoard.WithClock(clock))
+//     clock.Advance(11 * time.Second)
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// ManualSweep disables the flush manager, so that the hoard never starts a
+// goroutine to remove expired objects. They are removed when the application
+// calls Sweep, and by Set, which sweeps a small batch of the objects of the
+// shard of the key it stores at most once every expiration check interval.
+//
+// Expired objects are never returned either way, but they stay in the cache
+// until they are swept.
+func ManualSweep() Option {
+	return func(o *options) {
+		o.manualSweep = true
+	}
+}
+
+// SweepBudget limits the work done by every tick of the flush manager, and
+// every call to Sweep, to looking at maxKeys objects and spending
+// maxDuration, so that hoards with many objects expiring at once do not
+// stall. A limit of zero, the default, means there is none.
+//
+// Whatever is left when the budget runs out is carried on with by the next
+// sweep, starting with the objects which expired first, and the objects with
+// an expiration condition after the last one checked. Sweeps start with a
+// different shard every time, so that all of them get their turn.
+//
+// Expired objects are never returned, even if they have not been swept yet.
+// Objects are swept in small batches whatever the budget, and the locks of
+// the shard are released between batches.
+func SweepBudget(maxKeys int, maxDuration time.Duration) Option {
+	return func(o *options) {
+		o.sweepKeys = maxKeys
+		o.sweepDuration = maxDuration
+	}
+}
@@ -0,0 +1,61 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMaxEntries(t *testing.T) {
+
+	o := makeOptions([]Option{MaxEntries(10)})
+	assert.Equal(t, 10, o.maxEntries)
+
+	o = makeOptions(nil)
+	assert.Equal(t, 0, o.maxEntries)
+
+}
+
+func TestMaxCost(t *testing.T) {
+
+	o := makeOptions([]Option{MaxCost(1024), MaxEntries(10)})
+	assert.Equal(t, int64(1024), o.maxCost)
+	assert.Equal(t, 10, o.maxEntries)
+
+}
+
+func TestShards(t *testing.T) {
+
+	o := makeOptions([]Option{Shards(8)})
+	assert.Equal(t, 8, o.shards)
+
+}
+
+func TestWithClock(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	o := makeOptions([]Option{WithClock(clock)})
+	assert.Equal(t, clock, o.clock)
+
+	h := Make(ExpiresNever)
+	assert.Equal(t, systemClock{}, h.clock)
+
+}
+
+func TestManualSweep(t *testing.T) {
+
+	o := makeOptions([]Option{ManualSweep()})
+	assert.True(t, o.manualSweep)
+
+	o = makeOptions(nil)
+	assert.False(t, o.manualSweep)
+
+}
+
+func TestSweepBudget(t *testing.T) {
+
+	o := makeOptions([]Option{SweepBudget(1000, time.Millisecond)})
+	assert.Equal(t, 1000, o.sweepKeys)
+	assert.Equal(t, time.Millisecond, o.sweepDuration)
+
+}
@@ -0,0 +1,598 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/hoard"
+	"hash/maphash"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRelativeExptime is the largest exptime memcached treats as a number of
+// seconds from now. Larger ones are Unix times.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// maxKeyLength is the longest key memcached accepts.
+const maxKeyLength = 250
+
+// maxItemSize is the largest value a memcached client may store.
+const maxItemSize = 1 << 20
+
+// Version is the version reported to memcached clients.
+const Version = "1.6.0-hoard"
+
+// Item is the data stored in the hoard for values set by memcached clients,
+// carrying the flags and CAS number of the value along with it.
+//
+// Items must not be modified once they are stored.
+type Item struct {
+
+	// Value is the value set by the client.
+	Value []byte
+
+	// Flags are the opaque flags set by the client with the value.
+	Flags uint32
+
+	// CAS is the unique number of this version of the value, which changes
+	// whenever the value is set.
+	CAS uint64
+}
+
+// Memcached serves a Hoard over the memcached text protocol.
+//
+// It supports the get, gets, set, add, replace, cas, delete, touch, incr,
+// decr, flush_all, stats, version and quit commands. Values set by clients are
+// stored as *Item. Data stored by Go code is sent to clients as it is if it
+// is a string or byte slice, and as formatted by fmt.Sprint otherwise, with no
+// flags and a CAS number of zero.
+//
+// An exptime of zero stores a value that never expires, an exptime up to 30
+// days is a number of seconds from now, and a larger one is a Unix time.
+//
+// Commands checking the value before changing it, such as add, cas and incr,
+// are atomic with respect to other memcached clients, but not to Go code
+// using the hoard at the same time.
+type Memcached struct {
+	base
+
+	// hoard is the hoard being served.
+	hoard *hoard.Hoard
+
+	// cas is the last CAS number given to an item.
+	cas atomic.Uint64
+
+	// seed is used to hash the keys to their lock.
+	seed maphash.Seed
+
+	// keyDeadbolts make commands checking the value before changing it
+	// atomic, by locking the keys they change.
+	keyDeadbolts [64]sync.Mutex
+
+	// started is when the server was created.
+	started time.Time
+
+	// flushTimer clears the hoard once the delay given to the last
+	// flush_all command with one has passed, or is nil. It is protected by
+	// the deadbolt.
+	flushTimer *time.Timer
+
+	// stats count the commands of the clients.
+	stats memcachedStats
+}
+
+// memcachedStats count the commands of the clients, for the stats command.
+type memcachedStats struct {
+	currConnections  atomic.Int64
+	totalConnections atomic.Uint64
+	cmdGet           atomic.Uint64
+	cmdSet           atomic.Uint64
+	cmdTouch         atomic.Uint64
+	casMisses        atomic.Uint64
+	casHits          atomic.Uint64
+	casBadval        atomic.Uint64
+	deleteHits       atomic.Uint64
+	deleteMisses     atomic.Uint64
+	incrHits         atomic.Uint64
+	incrMisses       atomic.Uint64
+	decrHits         atomic.Uint64
+	decrMisses       atomic.Uint64
+	touchHits        atomic.Uint64
+	touchMisses      atomic.Uint64
+}
+
+// NewMemcached creates a new *Memcached server serving the hoard.
+func NewMemcached(h *hoard.Hoard) *Memcached {
+	return &Memcached{hoard: h, seed: maphash.MakeSeed(), started: time.Now()}
+}
+
+// ListenAndServe listens on the network address, such as "tcp" and ":11211"
+// or "unix" and "/run/hoard.sock", and serves clients connecting to it until
+// the server is closed.
+func (s *Memcached) ListenAndServe(network, address string) error {
+	return s.listenAndServe(network, address, s.handle)
+}
+
+// Serve serves clients connecting to the listener until the server is
+// closed.
+func (s *Memcached) Serve(l net.Listener) error {
+	return s.serve(l, s.handle)
+}
+
+// lock locks the key against other commands changing it, returning the func
+// unlocking it.
+func (s *Memcached) lock(key string) func() {
+	deadbolt := &s.keyDeadbolts[maphash.String(s.seed, key)%uint64(len(s.keyDeadbolts))]
+	deadbolt.Lock()
+	return deadbolt.Unlock
+}
+
+// item retrieves the item for the key, and whether it was in the hoard.
+func (s *Memcached) item(key string) (*Item, bool) {
+	data, ok := lookup(s.hoard, key)
+	if !ok {
+		return nil, false
+	}
+	if item, isItem := data.(*Item); isItem {
+		return item, true
+	}
+	return &Item{Value: []byte(format(data))}, true
+}
+
+// store stores a new version of the item for the key.
+func (s *Memcached) store(key string, value []byte, flags uint32, expiration *hoard.Expiration) {
+	s.hoard.Set(key, &Item{Value: value, Flags: flags, CAS: s.cas.Add(1)}, expiration)
+}
+
+// expiration translates a memcached exptime into an expiration policy, which
+// is nil if the value has expired already by now.
+func expiration(exptime int64, now time.Time) *hoard.Expiration {
+	switch {
+	case exptime == 0:
+		return hoard.ExpiresNever
+	case exptime < 0:
+		return nil
+	case exptime <= maxRelativeExptime:
+		return hoard.Expires().AfterSeconds(exptime)
+	}
+	date := time.Unix(exptime, 0)
+	if !date.After(now) {
+		return nil
+	}
+	return hoard.Expires().OnDate(date)
+}
+
+// handle serves the commands of a client until it disconnects or quits.
+func (s *Memcached) handle(conn net.Conn) {
+
+	s.stats.currConnections.Add(1)
+	s.stats.totalConnections.Add(1)
+	defer s.stats.currConnections.Add(-1)
+
+	in := bufio.NewReader(conn)
+	out := bufio.NewWriter(conn)
+
+	for {
+		line, err := readLine(in)
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			out.WriteString("ERROR\r\n")
+		} else if quit := s.execute(in, out, fields); quit {
+			out.Flush()
+			return
+		}
+
+		// pipelined commands are answered together
+		if in.Buffered() == 0 {
+			if out.Flush() != nil {
+				return
+			}
+		}
+	}
+
+}
+
+// execute executes a command, returning whether the client quit or must be
+// disconnected.
+func (s *Memcached) execute(in *bufio.Reader, out *bufio.Writer, fields []string) bool {
+
+	command, args := fields[0], fields[1:]
+
+	// the replies to storage commands may be turned off
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	reply := func(message string) {
+		if !noreply {
+			out.WriteString(message + "\r\n")
+		}
+	}
+
+	switch command {
+
+	case "get", "gets":
+		if len(args) == 0 {
+			out.WriteString("ERROR\r\n")
+			return false
+		}
+		for _, key := range args {
+			s.stats.cmdGet.Add(1)
+			item, ok := s.item(key)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(out, "VALUE %s %d %d", key, item.Flags, len(item.Value))
+			if command == "gets" {
+				fmt.Fprintf(out, " %d", item.CAS)
+			}
+			out.WriteString("\r\n")
+			out.Write(item.Value)
+			out.WriteString("\r\n")
+		}
+		out.WriteString("END\r\n")
+
+	case "set", "add", "replace", "cas":
+		return s.storage(in, out, command, args, noreply, reply)
+
+	case "delete":
+		if len(args) < 1 || !validKey(args[0]) {
+			out.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+		unlock := s.lock(args[0])
+		ok := s.hoard.Has(args[0])
+		if ok {
+			s.hoard.Remove(args[0])
+		}
+		unlock()
+		if ok {
+			s.stats.deleteHits.Add(1)
+			reply("DELETED")
+		} else {
+			s.stats.deleteMisses.Add(1)
+			reply("NOT_FOUND")
+		}
+
+	case "touch":
+		if len(args) < 2 || !validKey(args[0]) {
+			out.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			out.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return false
+		}
+		s.stats.cmdTouch.Add(1)
+		if s.touch(args[0], exptime) {
+			s.stats.touchHits.Add(1)
+			reply("TOUCHED")
+		} else {
+			s.stats.touchMisses.Add(1)
+			reply("NOT_FOUND")
+		}
+
+	case "incr", "decr":
+		if len(args) < 2 || !validKey(args[0]) {
+			out.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			out.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return false
+		}
+		s.arithmetic(command, args[0], delta, reply)
+
+	case "flush_all":
+		delay := int64(0)
+		if len(args) > 0 && args[0] != "noreply" {
+			var err error
+			if delay, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+				out.WriteString("CLIENT_ERROR bad command line format\r\n")
+				return false
+			}
+		}
+		if delay > 0 {
+			s.flushAfter(time.Duration(delay) * time.Second)
+		} else {
+			s.hoard.Clear()
+		}
+		reply("OK")
+
+	case "stats":
+		if len(args) > 0 {
+			// only the general statistics are supported
+			out.WriteString("END\r\n")
+			return false
+		}
+		s.writeStats(out)
+
+	case "version":
+		out.WriteString("VERSION " + Version + "\r\n")
+
+	case "quit":
+		return true
+
+	default:
+		out.WriteString("ERROR\r\n")
+	}
+
+	return false
+
+}
+
+// storage executes the set, add, replace and cas commands, returning whether
+// the client must be disconnected.
+func (s *Memcached) storage(in *bufio.Reader, out *bufio.Writer, command string, args []string, noreply bool, reply func(string)) bool {
+
+	arguments := 4
+	if command == "cas" {
+		arguments = 5
+	}
+	if len(args) < arguments || !validKey(args[0]) {
+		out.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+
+	key := args[0]
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		out.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		out.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	length, err := strconv.Atoi(args[3])
+	if err != nil || length < 0 {
+		out.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	var unique uint64
+	if command == "cas" {
+		if unique, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			out.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+	}
+
+	if length > maxItemSize {
+		// the data cannot be told apart from the next command, so the
+		// client is disconnected
+		out.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return true
+	}
+	if string(data[length:]) != "\r\n" {
+		out.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	value := data[:length]
+
+	s.stats.cmdSet.Add(1)
+
+	unlock := s.lock(key)
+	defer unlock()
+
+	// only cas needs the current item, and looking it up counts as a hit or
+	// miss in the statistics of the hoard
+	var current *Item
+	var exists bool
+	if command == "cas" {
+		current, exists = s.item(key)
+	} else {
+		exists = s.hoard.Has(key)
+	}
+
+	switch command {
+	case "add":
+		if exists {
+			reply("NOT_STORED")
+			return false
+		}
+	case "replace":
+		if !exists {
+			reply("NOT_STORED")
+			return false
+		}
+	case "cas":
+		if !exists {
+			s.stats.casMisses.Add(1)
+			reply("NOT_FOUND")
+			return false
+		}
+		if current.CAS != unique {
+			s.stats.casBadval.Add(1)
+			reply("EXISTS")
+			return false
+		}
+		s.stats.casHits.Add(1)
+	}
+
+	exp := expiration(exptime, s.hoard.Clock().Now())
+	if exp == nil {
+		// storing an expired value removes the current one
+		s.hoard.Remove(key)
+	} else {
+		s.store(key, value, uint32(flags), exp)
+	}
+	reply("STORED")
+
+	return false
+
+}
+
+// touch sets a new exptime for the key, returning whether it exists.
+func (s *Memcached) touch(key string, exptime int64) bool {
+
+	unlock := s.lock(key)
+	defer unlock()
+
+	if !s.hoard.Has(key) {
+		return false
+	}
+
+	now := s.hoard.Clock().Now()
+	exp := expiration(exptime, now)
+	switch {
+	case exp == nil:
+		s.hoard.Remove(key)
+	case exptime > 0 && exptime <= maxRelativeExptime:
+		// durations count from when the value was set, so the time
+		// from now is set as a date
+		return s.hoard.SetExpires(key, hoard.Expires().OnDate(now.Add(time.Duration(exptime)*time.Second)))
+	default:
+		return s.hoard.SetExpires(key, exp)
+	}
+
+	return true
+
+}
+
+// arithmetic executes the incr and decr commands.
+func (s *Memcached) arithmetic(command, key string, delta uint64, reply func(string)) {
+
+	hits, misses := &s.stats.incrHits, &s.stats.incrMisses
+	if command == "decr" {
+		hits, misses = &s.stats.decrHits, &s.stats.decrMisses
+	}
+
+	unlock := s.lock(key)
+	defer unlock()
+
+	item, ok := s.item(key)
+	if !ok {
+		misses.Add(1)
+		reply("NOT_FOUND")
+		return
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+	if err != nil {
+		reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		return
+	}
+
+	if command == "incr" {
+		// incrementing wraps around at 64 bits
+		value += delta
+	} else if delta > value {
+		// decrementing stops at zero
+		value = 0
+	} else {
+		value -= delta
+	}
+
+	// the new value keeps the time at which the old one expires
+	exp := hoard.ExpiresNever
+	if expiresAt, _ := s.hoard.ExpiresAt(key); !expiresAt.IsZero() {
+		exp = hoard.Expires().OnDate(expiresAt)
+	}
+
+	result := strconv.FormatUint(value, 10)
+	s.store(key, []byte(result), item.Flags, exp)
+
+	hits.Add(1)
+	reply(result)
+
+}
+
+// flushAfter clears the hoard after delay, replacing the flush waiting to
+// happen, if any, unless the server has been closed.
+func (s *Memcached) flushAfter(delay time.Duration) {
+	s.deadbolt.Lock()
+	defer s.deadbolt.Unlock()
+
+	if s.closed {
+		return
+	}
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+	}
+	s.flushTimer = time.AfterFunc(delay, s.hoard.Clear)
+}
+
+// Close closes all listeners and connections, waits for the connections
+// being handled to finish, and stops the flush waiting to happen, if any, so
+// that the hoard is not cleared once the server is closed.
+func (s *Memcached) Close() error {
+	err := s.base.Close()
+
+	s.deadbolt.Lock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+	}
+	s.deadbolt.Unlock()
+
+	return err
+}
+
+// writeStats writes the statistics of the server and its hoard.
+func (s *Memcached) writeStats(out *bufio.Writer) {
+
+	stats := s.hoard.Stats()
+	now := time.Now()
+
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(out, "STAT %s %v\r\n", name, value)
+	}
+
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.started)/time.Second))
+	stat("time", now.Unix())
+	stat("version", Version)
+	stat("curr_connections", s.stats.currConnections.Load())
+	stat("total_connections", s.stats.totalConnections.Load())
+	stat("cmd_get", s.stats.cmdGet.Load())
+	stat("cmd_set", s.stats.cmdSet.Load())
+	stat("cmd_touch", s.stats.cmdTouch.Load())
+	stat("get_hits", stats.Hits)
+	stat("get_misses", stats.Misses)
+	stat("delete_hits", s.stats.deleteHits.Load())
+	stat("delete_misses", s.stats.deleteMisses.Load())
+	stat("incr_hits", s.stats.incrHits.Load())
+	stat("incr_misses", s.stats.incrMisses.Load())
+	stat("decr_hits", s.stats.decrHits.Load())
+	stat("decr_misses", s.stats.decrMisses.Load())
+	stat("cas_hits", s.stats.casHits.Load())
+	stat("cas_misses", s.stats.casMisses.Load())
+	stat("cas_badval", s.stats.casBadval.Load())
+	stat("touch_hits", s.stats.touchHits.Load())
+	stat("touch_misses", s.stats.touchMisses.Load())
+	stat("curr_items", stats.Entries)
+	stat("evictions", stats.Evictions)
+	stat("expired", stats.Expirations)
+	stat("removals", stats.Removals)
+	stat("loads", stats.Loads)
+	stat("load_errors", stats.LoadErrors)
+	out.WriteString("END\r\n")
+
+}
+
+// validKey returns whether the key is acceptable to memcached.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/hoard"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memcachedClient talks to a memcached server in tests.
+type memcachedClient struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// startMemcached serves the hoard on a loopback port, returning a client.
+func startMemcached(t *testing.T, h *hoard.Hoard) *memcachedClient {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewMemcached(h)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &memcachedClient{conn, bufio.NewReader(conn)}
+}
+
+// do sends a command and returns the lines of its reply, up to and including
+// the line ending the reply.
+func (c *memcachedClient) do(command string) string {
+	c.conn.Write([]byte(command + "\r\n"))
+
+	var lines []string
+	for {
+		line, err := c.in.ReadString('\n')
+		if err != nil {
+			return strings.Join(lines, "|")
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if !strings.HasPrefix(line, "VALUE ") && !strings.HasPrefix(line, "STAT ") && !isValueLine(lines) {
+			return strings.Join(lines, "|")
+		}
+	}
+}
+
+// isValueLine returns whether the last line is the data of a VALUE line.
+func isValueLine(lines []string) bool {
+	return len(lines) >= 2 && strings.HasPrefix(lines[len(lines)-2], "VALUE ")
+}
+
+func TestMemcached_Storage(t *testing.T) {
+
+	h := hoard.Make(hoard.ExpiresNever)
+	h.Set("go", "from go")
+	c := startMemcached(t, h)
+
+	assert.Equal(t, "STORED", c.do("set key 5 0 5\r\nvalue"))
+	assert.Equal(t, "VALUE key 5 5|value|END", c.do("get key missing"))
+	assert.Equal(t, "VALUE go 0 7|from go|END", c.do("get go"))
+	assert.Equal(t, []byte("value"), h.Get("key").(*Item).Value)
+
+	assert.Equal(t, "NOT_STORED", c.do("add key 0 0 1\r\nx"))
+	assert.Equal(t, "STORED", c.do("add other 0 0 1\r\nx"))
+	assert.Equal(t, "NOT_STORED", c.do("replace missing 0 0 1\r\nx"))
+	assert.Equal(t, "STORED", c.do("replace other 0 0 1\r\ny"))
+
+	assert.Equal(t, "DELETED", c.do("delete other"))
+	assert.Equal(t, "NOT_FOUND", c.do("delete other"))
+
+	assert.Equal(t, "CLIENT_ERROR bad data chunk", c.do("set key 0 0 1\r\ntoo long"))
+	assert.Equal(t, "ERROR", c.do("bogus"))
+
+	c.do("set quiet 0 0 1 noreply\r\nq")
+	assert.Equal(t, "VALUE quiet 0 1|q|END", c.do("get quiet"))
+
+}
+
+func TestMemcached_CAS(t *testing.T) {
+
+	c := startMemcached(t, hoard.Make(hoard.ExpiresNever))
+
+	c.do("set key 0 0 1\r\na")
+	reply := c.do("gets key")
+	unique := strings.Fields(strings.Split(reply, "|")[0])[4]
+
+	assert.Equal(t, "STORED", c.do("cas key 0 0 1 "+unique+"\r\nb"))
+	assert.Equal(t, "EXISTS", c.do("cas key 0 0 1 "+unique+"\r\nc"))
+	assert.Equal(t, "NOT_FOUND", c.do("cas missing 0 0 1 1\r\nc"))
+	assert.Equal(t, "VALUE key 0 1|b|END", c.do("get key"))
+
+}
+
+func TestMemcached_Arithmetic(t *testing.T) {
+
+	c := startMemcached(t, hoard.Make(hoard.ExpiresNever))
+
+	c.do("set counter 3 0 2\r\n10")
+	assert.Equal(t, "15", c.do("incr counter 5"))
+	assert.Equal(t, "0", c.do("decr counter 20"))
+	assert.Equal(t, "18446744073709551615", c.do("incr counter 18446744073709551615"))
+	assert.Equal(t, "VALUE counter 3 20|18446744073709551615|END", c.do("get counter"))
+	assert.Equal(t, "NOT_FOUND", c.do("incr missing 1"))
+
+	c.do("set text 0 0 4\r\ntext")
+	assert.Equal(t, "CLIENT_ERROR cannot increment or decrement non-numeric value", c.do("incr text 1"))
+
+}
+
+func TestMemcached_ExpirationClock(t *testing.T) {
+
+	clock := hoard.NewFakeClock(time.Now().Add(time.Hour))
+	h := hoard.Make(hoard.ExpiresNever, hoard.WithClock(clock))
+	c := startMemcached(t, h)
+
+	// dates and touches are measured by the clock of the hoard
+	date := clock.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, "STORED", c.do("set past 0 "+strconv.FormatInt(date, 10)+" 1\r\nx"))
+	assert.False(t, h.Has("past"))
+
+	c.do("set key 0 0 1\r\nx")
+	assert.Equal(t, "TOUCHED", c.do("touch key 10"))
+	expiresAt, _ := h.ExpiresAt("key")
+	assert.True(t, clock.Now().Add(10*time.Second).Equal(expiresAt))
+
+}
+
+func TestMemcached_Expiration(t *testing.T) {
+
+	h := hoard.Make(hoard.ExpiresNever)
+	c := startMemcached(t, h)
+
+	c.do("set never 0 0 1\r\nx")
+	expiresAt, _ := h.ExpiresAt("never")
+	assert.True(t, expiresAt.IsZero())
+
+	c.do("set relative 0 100 1\r\nx")
+	expiresAt, _ = h.ExpiresAt("relative")
+	assert.WithinDuration(t, time.Now().Add(100*time.Second), expiresAt, time.Second)
+
+	date := time.Now().Add(time.Hour).Unix()
+	c.do("set absolute 0 " + strconv.FormatInt(date, 10) + " 1\r\nx")
+	expiresAt, _ = h.ExpiresAt("absolute")
+	assert.Equal(t, date, expiresAt.Unix())
+
+	assert.Equal(t, "TOUCHED", c.do("touch never 10"))
+	expiresAt, _ = h.ExpiresAt("never")
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), expiresAt, time.Second)
+	assert.Equal(t, "NOT_FOUND", c.do("touch missing 10"))
+
+	assert.Equal(t, "STORED", c.do("set relative 0 -1 1\r\nx"))
+	assert.False(t, h.Has("relative"))
+
+	assert.Equal(t, "OK", c.do("flush_all"))
+	assert.Equal(t, "END", c.do("get never absolute"))
+
+}
+
+func TestMemcached_DelayedFlushStopsOnClose(t *testing.T) {
+
+	h := hoard.Make(hoard.ExpiresNever)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewMemcached(h)
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &memcachedClient{conn, bufio.NewReader(conn)}
+
+	c.do("set key 0 0 1\r\nx")
+	assert.Equal(t, "OK", c.do("flush_all 60"))
+	assert.True(t, h.Has("key"))
+
+	// the flush waiting to happen is stopped, and no more are started
+	assert.NoError(t, s.Close())
+	assert.False(t, s.flushTimer.Stop())
+	timer := s.flushTimer
+	s.flushAfter(time.Millisecond)
+	assert.Equal(t, timer, s.flushTimer)
+
+}
+
+func TestMemcached_Stats(t *testing.T) {
+
+	c := startMemcached(t, hoard.Make(hoard.ExpiresNever))
+
+	c.do("set key 0 0 1\r\nx")
+	c.do("get key")
+	c.do("get missing")
+
+	stats := make(map[string]string)
+	for _, line := range strings.Split(c.do("stats"), "|") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 {
+			stats[fields[1]] = fields[2]
+		}
+	}
+
+	assert.Equal(t, "1", stats["get_hits"])
+	assert.Equal(t, "1", stats["get_misses"])
+	assert.Equal(t, "2", stats["cmd_get"])
+	assert.Equal(t, "1", stats["cmd_set"])
+	assert.Equal(t, "1", stats["curr_items"])
+	assert.Equal(t, "1", stats["curr_connections"])
+	assert.Equal(t, "VERSION "+Version, c.do("version"))
+
+}
@@ -0,0 +1,561 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/stretchr/hoard"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBulkLength is the largest argument a RESP client may send.
+const maxBulkLength = 512 << 20
+
+// errProtocol is returned when a client does not speak RESP properly, which
+// ends its connection.
+var errProtocol = errors.New("protocol error")
+
+// RESP serves a Hoard over the Redis serialization protocol, so that Redis
+// clients such as redis-cli can use it.
+//
+// It supports the GET, SET (with EX and PX), DEL, EXISTS, TTL, PTTL, EXPIRE,
+// PEXPIRE, PERSIST, KEYS, SCAN, FLUSHALL, PING, ECHO and QUIT commands.
+//
+// Values set by clients are stored as strings. Values stored by Go code are
+// sent to clients as they are if they are strings or byte slices, and as
+// formatted by fmt.Sprint otherwise.
+//
+// SET without EX or PX stores values with the default expiration policy of
+// the hoard.
+type RESP struct {
+	base
+
+	// hoard is the hoard being served.
+	hoard *hoard.Hoard
+}
+
+// NewRESP creates a new *RESP server serving the hoard.
+func NewRESP(h *hoard.Hoard) *RESP {
+	return &RESP{hoard: h}
+}
+
+// ListenAndServe listens on the network address, such as "tcp" and ":6379"
+// or "unix" and "/run/hoard.sock", and serves clients connecting to it until
+// the server is closed.
+func (s *RESP) ListenAndServe(network, address string) error {
+	return s.listenAndServe(network, address, s.handle)
+}
+
+// Serve serves clients connecting to the listener until the server is
+// closed.
+func (s *RESP) Serve(l net.Listener) error {
+	return s.serve(l, s.handle)
+}
+
+// respWriter writes RESP replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w respWriter) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w respWriter) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w respWriter) strings(values []string) {
+	w.array(len(values))
+	for _, value := range values {
+		w.bulk(value)
+	}
+}
+
+// handle serves the commands of a client until it disconnects or quits.
+func (s *RESP) handle(conn net.Conn) {
+
+	in := bufio.NewReader(conn)
+	out := respWriter{bufio.NewWriter(conn)}
+
+	for {
+		args, err := readCommand(in)
+		if err != nil {
+			if err == errProtocol {
+				out.error("ERR Protocol error")
+				out.Flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.execute(out, args)
+
+		// pipelined commands are answered together
+		if in.Buffered() == 0 || quit {
+			if out.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+
+}
+
+// readCommand reads a command, either as an array of bulk strings as sent by
+// clients, or as an inline command as typed into telnet.
+func readCommand(in *bufio.Reader) ([]string, error) {
+
+	line, err := readLine(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 1024*1024 {
+		return nil, errProtocol
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(in)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errProtocol
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, errProtocol
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(in, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:length]))
+	}
+
+	return args, nil
+}
+
+// readLine reads a line ending with CRLF, or LF for inline commands, without
+// the line ending.
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// execute executes a command, returning whether the client quit.
+func (s *RESP) execute(out respWriter, args []string) bool {
+
+	h := s.hoard
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+
+	arity, known := respArity[command]
+	if !known {
+		out.error(fmt.Sprintf("ERR unknown command '%s'", command))
+		return false
+	}
+	if len(args) < arity.min || (arity.max >= 0 && len(args) > arity.max) {
+		out.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+		return false
+	}
+
+	switch command {
+
+	case "PING":
+		if len(args) == 1 {
+			out.bulk(args[0])
+		} else {
+			out.simple("PONG")
+		}
+
+	case "ECHO":
+		out.bulk(args[0])
+
+	case "QUIT":
+		out.simple("OK")
+		return true
+
+	case "COMMAND":
+		// redis-cli asks for the documentation of the commands, which is
+		// not needed to use them
+		out.array(0)
+
+	case "GET":
+		data, ok := lookup(h, args[0])
+		if !ok {
+			out.null()
+			return false
+		}
+		out.bulk(format(data))
+
+	case "SET":
+		expiration := hoard.ExpiresDefault
+		options := args[2:]
+		for len(options) > 0 {
+			option := strings.ToUpper(options[0])
+			if (option != "EX" && option != "PX") || len(options) < 2 || expiration != nil {
+				out.error("ERR syntax error")
+				return false
+			}
+			unit := time.Millisecond
+			if option == "EX" {
+				unit = time.Second
+			}
+			n, err := strconv.ParseInt(options[1], 10, 64)
+			ttl, valid := expireIn(n, unit, h.Clock().Now())
+			if err != nil || n <= 0 || !valid {
+				out.error("ERR invalid expire time in 'set' command")
+				return false
+			}
+			expiration = hoard.Expires().AfterDuration(ttl)
+			options = options[2:]
+		}
+		h.Set(args[0], args[1], expiration)
+		out.simple("OK")
+
+	case "DEL":
+		var removed int64
+		for _, key := range args {
+			if h.Has(key) {
+				h.Remove(key)
+				removed++
+			}
+		}
+		out.integer(removed)
+
+	case "EXISTS":
+		var existing int64
+		for _, key := range args {
+			if _, ok := lookup(h, key); ok {
+				existing++
+			}
+		}
+		out.integer(existing)
+
+	case "TTL", "PTTL":
+		expiresAt, ok := h.ExpiresAt(args[0])
+		ttl := expiresAt.Sub(h.Clock().Now())
+		switch {
+		case !ok:
+			out.integer(-2)
+		case expiresAt.IsZero():
+			out.integer(-1)
+		case command == "TTL":
+			out.integer(int64((ttl + time.Second/2) / time.Second))
+		default:
+			out.integer(int64((ttl + time.Millisecond/2) / time.Millisecond))
+		}
+
+	case "EXPIRE", "PEXPIRE":
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			out.error("ERR value is not an integer or out of range")
+			return false
+		}
+		unit := time.Millisecond
+		if command == "EXPIRE" {
+			unit = time.Second
+		}
+		if !h.Has(args[0]) {
+			out.integer(0)
+			return false
+		}
+		if n <= 0 {
+			h.Remove(args[0])
+			out.integer(1)
+			return false
+		}
+		now := h.Clock().Now()
+		ttl, valid := expireIn(n, unit, now)
+		if !valid {
+			out.error(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(command)))
+			return false
+		}
+		// the time is counted from now rather than from when the value
+		// was set, so it is set as a date
+		if h.SetExpires(args[0], hoard.Expires().OnDate(now.Add(ttl))) {
+			out.integer(1)
+		} else {
+			out.integer(0)
+		}
+
+	case "PERSIST":
+		expiresAt, ok := h.ExpiresAt(args[0])
+		if !ok || expiresAt.IsZero() {
+			out.integer(0)
+			return false
+		}
+		if h.SetExpires(args[0], hoard.ExpiresNever) {
+			out.integer(1)
+		} else {
+			out.integer(0)
+		}
+
+	case "KEYS":
+		out.strings(matchingKeys(h, args[0]))
+
+	case "SCAN":
+		cursor, err := strconv.Atoi(args[0])
+		if err != nil || cursor < 0 {
+			out.error("ERR invalid cursor")
+			return false
+		}
+		pattern, count := "*", 10
+		options := args[1:]
+		for len(options) > 0 {
+			if len(options) < 2 {
+				out.error("ERR syntax error")
+				return false
+			}
+			switch strings.ToUpper(options[0]) {
+			case "MATCH":
+				pattern = options[1]
+			case "COUNT":
+				count, err = strconv.Atoi(options[1])
+				if err != nil || count < 1 {
+					out.error("ERR syntax error")
+					return false
+				}
+			default:
+				out.error("ERR syntax error")
+				return false
+			}
+			options = options[2:]
+		}
+		scan(out, h, cursor, pattern, count)
+
+	case "FLUSHALL", "FLUSHDB":
+		h.Clear()
+		out.simple("OK")
+
+	}
+
+	return false
+
+}
+
+// respArity holds the minimum and maximum number of arguments of each
+// command, with a maximum of -1 for any number.
+var respArity = map[string]struct{ min, max int }{
+	"PING":     {0, 1},
+	"ECHO":     {1, 1},
+	"QUIT":     {0, 0},
+	"COMMAND":  {0, -1},
+	"GET":      {1, 1},
+	"SET":      {2, 4},
+	"DEL":      {1, -1},
+	"EXISTS":   {1, -1},
+	"TTL":      {1, 1},
+	"PTTL":     {1, 1},
+	"EXPIRE":   {2, 2},
+	"PEXPIRE":  {2, 2},
+	"PERSIST":  {1, 1},
+	"KEYS":     {1, 1},
+	"SCAN":     {1, 5},
+	"FLUSHALL": {0, 1},
+	"FLUSHDB":  {0, 1},
+}
+
+// lookup retrieves the data for the key, and whether it was in the hoard.
+func lookup(h *hoard.Hoard, key string) (interface{}, bool) {
+	data := h.Get(key)
+	if data != nil {
+		return data, true
+	}
+	// nil may have been stored by Go code
+	return nil, h.Has(key)
+}
+
+// format formats data for clients.
+func format(data interface{}) string {
+	switch data := data.(type) {
+	case string:
+		return data
+	case []byte:
+		return string(data)
+	}
+	return fmt.Sprint(data)
+}
+
+// matchingKeys returns the keys of the hoard matching the pattern, sorted so
+// that SCAN cursors stay meaningful between calls.
+func matchingKeys(h *hoard.Hoard, pattern string) []string {
+	keys := h.Keys()
+	matching := keys[:0]
+	for _, key := range keys {
+		if match(pattern, key) {
+			matching = append(matching, key)
+		}
+	}
+	sort.Strings(matching)
+	return matching
+}
+
+// scan replies with up to count keys matching the pattern, starting at the
+// cursor, which is the number of keys already returned.
+//
+// Keys added or removed between calls may shift the cursor, so like Redis,
+// SCAN may return some keys more than once or miss keys that changed during
+// the iteration.
+func scan(out respWriter, h *hoard.Hoard, cursor int, pattern string, count int) {
+	keys := matchingKeys(h, pattern)
+
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	end := cursor + count
+	if end >= len(keys) {
+		end = 0
+		keys = keys[cursor:]
+	} else {
+		keys = keys[cursor:end]
+	}
+
+	out.array(2)
+	out.bulk(strconv.Itoa(end))
+	out.strings(keys)
+}
+
+// match reports whether the key matches the glob style pattern, which may use
+// *, ?, character classes like [a-z] or [^abc], and \ to escape them.
+//
+// When the rest of the pattern does not match, only the last * is tried
+// against a longer part of the key, which is enough as every other part of
+// the pattern matches a single character. Matching therefore takes at most
+// the length of the pattern times the length of the key, rather than growing
+// exponentially with the number of *.
+func match(pattern, key string) bool {
+
+	// starPattern and starKey are where matching carries on from after the
+	// last *, once it has been tried against one more character of the key
+	var starPattern, starKey string
+	star := false
+
+	for {
+		if len(pattern) > 0 && pattern[0] == '*' {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			star, starPattern, starKey = true, pattern, key
+			continue
+		}
+
+		if len(pattern) == 0 && len(key) == 0 {
+			return true
+		}
+
+		if rest, ok := matchChar(pattern, key); ok {
+			pattern, key = rest, key[1:]
+			continue
+		}
+
+		if !star || len(starKey) == 0 {
+			return false
+		}
+		starKey = starKey[1:]
+		pattern, key = starPattern, starKey
+	}
+
+}
+
+// matchChar reports whether the first character of the key matches the start
+// of the pattern, which is not a *, returning the rest of the pattern.
+func matchChar(pattern, key string) (string, bool) {
+
+	if len(pattern) == 0 || len(key) == 0 {
+		return pattern, false
+	}
+
+	switch pattern[0] {
+
+	case '?':
+		return pattern[1:], true
+
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// an unterminated class matches itself
+			return pattern[1:], key[0] == '['
+		}
+		class := pattern[1 : end+1]
+		negated := strings.HasPrefix(class, "^")
+		if negated {
+			class = class[1:]
+		}
+		return pattern[end+2:], inClass(class, key[0]) != negated
+
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+
+	return pattern[1:], pattern[0] == key[0]
+
+}
+
+// expireIn converts n units into the time to live of a key from now,
+// returning false if it is too long for the time the key expires to be
+// represented, rather than letting it overflow into the past.
+func expireIn(n int64, unit time.Duration, now time.Time) (time.Duration, bool) {
+	if n > (math.MaxInt64-now.UnixNano())/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// inClass reports whether c is in the character class, such as "abc" or
+// "a-z".
+func inClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/hoard"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respClient talks to a RESP server in tests.
+type respClient struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// startRESP serves the hoard on a loopback port, returning a client.
+func startRESP(t *testing.T, h *hoard.Hoard) *respClient {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewRESP(h)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &respClient{conn, bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply, with arrays flattened into a
+// space separated list of their elements.
+func (c *respClient) do(args ...string) string {
+	command := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		command += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	c.conn.Write([]byte(command))
+	return c.reply()
+}
+
+// reply reads a reply.
+func (c *respClient) reply() string {
+	line, _ := c.in.ReadString('\n')
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		value, _ := c.in.ReadString('\n')
+		return strings.TrimSuffix(value, "\r\n")
+	case '*':
+		var elements []string
+		n, _ := strconv.Atoi(line[1:])
+		for i := 0; i < n; i++ {
+			elements = append(elements, c.reply())
+		}
+		return "[" + strings.Join(elements, " ") + "]"
+	}
+	return line
+}
+
+func TestRESP_GetSet(t *testing.T) {
+
+	h := hoard.Make(hoard.ExpiresNever)
+	h.Set("number", 42)
+	c := startRESP(t, h)
+
+	assert.Equal(t, "+PONG", c.do("PING"))
+	assert.Equal(t, "(nil)", c.do("GET", "key"))
+	assert.Equal(t, "+OK", c.do("SET", "key", "value"))
+	assert.Equal(t, "value", c.do("get", "key"))
+	assert.Equal(t, "value", h.Get("key"))
+	assert.Equal(t, "42", c.do("GET", "number"))
+
+	assert.Equal(t, ":2", c.do("EXISTS", "key", "number", "missing"))
+	assert.Equal(t, ":1", c.do("DEL", "key", "missing"))
+	assert.Equal(t, ":0", c.do("EXISTS", "key"))
+
+	assert.Equal(t, "-ERR unknown command 'NOPE'", c.do("NOPE"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command", c.do("GET"))
+
+}
+
+func TestRESP_Expiration(t *testing.T) {
+
+	h := hoard.Make(hoard.ExpiresNever)
+	c := startRESP(t, h)
+
+	assert.Equal(t, ":-2", c.do("TTL", "key"))
+
+	c.do("SET", "key", "value")
+	assert.Equal(t, ":-1", c.do("TTL", "key"))
+
+	assert.Equal(t, "+OK", c.do("SET", "key", "value", "EX", "100"))
+	assert.Equal(t, ":100", c.do("TTL", "key"))
+
+	assert.Equal(t, ":1", c.do("PEXPIRE", "key", "5000"))
+	assert.Equal(t, ":5", c.do("TTL", "key"))
+	assert.Equal(t, ":0", c.do("PEXPIRE", "missing", "5000"))
+
+	assert.Equal(t, ":1", c.do("PERSIST", "key"))
+	assert.Equal(t, ":-1", c.do("TTL", "key"))
+	assert.Equal(t, ":0", c.do("PERSIST", "key"))
+
+	assert.Equal(t, "+OK", c.do("SET", "key", "value", "PX", "50"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "(nil)", c.do("GET", "key"))
+
+	assert.Equal(t, "-ERR syntax error", c.do("SET", "key", "value", "EX"))
+	assert.Equal(t, "-ERR invalid expire time in 'set' command", c.do("SET", "key", "value", "EX", "0"))
+
+	// times too far ahead are refused rather than overflowing into the past
+	assert.Equal(t, "-ERR invalid expire time in 'set' command", c.do("SET", "key", "value", "EX", "9223372036854775807"))
+	assert.Equal(t, "-ERR invalid expire time in 'set' command", c.do("SET", "key", "value", "PX", "9223372036854775807"))
+	assert.Equal(t, "+OK", c.do("SET", "key", "value"))
+	assert.Equal(t, "-ERR invalid expire time in 'expire' command", c.do("EXPIRE", "key", "9223372036854775807"))
+	assert.Equal(t, "-ERR invalid expire time in 'pexpire' command", c.do("PEXPIRE", "key", "9223372036854775807"))
+	assert.Equal(t, ":-1", c.do("TTL", "key"))
+
+}
+
+func TestRESP_ExpirationClock(t *testing.T) {
+
+	clock := hoard.NewFakeClock(time.Now())
+	h := hoard.Make(hoard.ExpiresNever, hoard.WithClock(clock))
+	c := startRESP(t, h)
+
+	// times to live are told by the clock of the hoard
+	assert.Equal(t, "+OK", c.do("SET", "key", "value", "EX", "100"))
+	clock.Advance(40 * time.Second)
+	assert.Equal(t, ":60", c.do("TTL", "key"))
+
+	assert.Equal(t, ":1", c.do("EXPIRE", "key", "10"))
+	clock.Advance(3 * time.Second)
+	assert.Equal(t, ":7000", c.do("PTTL", "key"))
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, "(nil)", c.do("GET", "key"))
+
+}
+
+func TestRESP_Keys(t *testing.T) {
+
+	h := hoard.Make(hoard.ExpiresNever)
+	c := startRESP(t, h)
+
+	for _, key := range []string{"user:1", "user:2", "user:10", "session:1"} {
+		c.do("SET", key, "value")
+	}
+
+	assert.Equal(t, "[user:1 user:10 user:2]", c.do("KEYS", "user:*"))
+	assert.Equal(t, "[user:1 user:2]", c.do("KEYS", "user:?"))
+	assert.Equal(t, "[session:1 user:1]", c.do("KEYS", "*[^0-9]1"))
+
+	assert.Equal(t, "[2 [session:1 user:1]]", c.do("SCAN", "0", "COUNT", "2"))
+	assert.Equal(t, "[0 [user:10 user:2]]", c.do("SCAN", "2", "COUNT", "2"))
+	assert.Equal(t, "[0 [user:10]]", c.do("SCAN", "0", "MATCH", "*0"))
+
+	assert.Equal(t, "+OK", c.do("FLUSHALL"))
+	assert.Equal(t, "[]", c.do("KEYS", "*"))
+
+}
+
+func TestRESP_Inline(t *testing.T) {
+
+	c := startRESP(t, hoard.Make(hoard.ExpiresNever))
+
+	c.conn.Write([]byte("SET key value\r\nGET key\r\n"))
+	assert.Equal(t, "+OK", c.reply())
+	assert.Equal(t, "value", c.reply())
+
+}
+
+func TestRESP_NegativeArrayLength(t *testing.T) {
+
+	c := startRESP(t, hoard.Make(hoard.ExpiresNever))
+
+	// the client is told off rather than crashing the server
+	c.conn.Write([]byte("*-1\r\n"))
+	assert.Equal(t, "-ERR Protocol error", c.reply())
+
+	c = startRESP(t, hoard.Make(hoard.ExpiresNever))
+	assert.Equal(t, "+PONG", c.do("PING"))
+
+}
+
+func TestMatch(t *testing.T) {
+
+	assert.True(t, match("*", ""))
+	assert.True(t, match("h?llo", "hello"))
+	assert.True(t, match("h*llo", "heeeello"))
+	assert.True(t, match("h[ae]llo", "hallo"))
+	assert.False(t, match("h[ae]llo", "hillo"))
+	assert.True(t, match("h[^e]llo", "hallo"))
+	assert.False(t, match("h[^e]llo", "hello"))
+	assert.True(t, match("h[a-b]llo", "hbllo"))
+	assert.True(t, match(`h\*llo`, "h*llo"))
+	assert.False(t, match(`h\*llo`, "hello"))
+	assert.True(t, match("*a*b", "xaxxab"))
+	assert.False(t, match("*a*b", "xaxxa"))
+	assert.True(t, match("a*", "a"))
+	assert.False(t, match("a*b", "a"))
+	assert.True(t, match("[", "["))
+	assert.False(t, match("[", "a"))
+
+	// patterns with many * do not take exponential time
+	key := strings.Repeat("a", 100)
+	assert.False(t, match(strings.Repeat("*a", 50)+"b", key))
+	assert.True(t, match(strings.Repeat("*a", 50), key))
+
+}
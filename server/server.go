@@ -0,0 +1,134 @@
+// Package server exposes a Hoard over network protocols spoken by existing
+// cache clients, so that tools which are not written in Go can use it.
+//
+// RESP speaks the Redis protocol and Memcached the memcached text protocol.
+// Every server serves one *hoard.Hoard on any number of listeners, which may
+// be TCP or Unix sockets:
+//
+//     h := hoard.Make(hoard.ExpiresNever)
+//     resp := server.NewRESP(h)
+//     go resp.ListenAndServe("tcp", ":6379")
+//     defer resp.Close()
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by the Serve and ListenAndServe methods of a
+// server once it has been closed.
+var ErrServerClosed = errors.New("server: closed")
+
+// base keeps track of the listeners and connections of a server, so that they
+// can all be closed.
+type base struct {
+
+	// listeners holds the listeners being served.
+	listeners map[net.Listener]struct{}
+
+	// conns holds the connections being served.
+	conns map[net.Conn]struct{}
+
+	// closed is whether the server has been closed.
+	closed bool
+
+	// deadbolt provides thread safety for the fields above.
+	deadbolt sync.Mutex
+
+	// handlers waits for the connection handlers to return.
+	handlers sync.WaitGroup
+}
+
+// listenAndServe listens on the network address and serves the connections.
+func (b *base) listenAndServe(network, address string, handle func(net.Conn)) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return b.serve(l, handle)
+}
+
+// serve accepts connections on the listener and handles each of them in its
+// own goroutine, until the listener fails or the server is closed. The
+// listener is closed before serve returns.
+func (b *base) serve(l net.Listener, handle func(net.Conn)) error {
+
+	b.deadbolt.Lock()
+	if b.closed {
+		b.deadbolt.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if b.listeners == nil {
+		b.listeners = make(map[net.Listener]struct{})
+		b.conns = make(map[net.Conn]struct{})
+	}
+	b.listeners[l] = struct{}{}
+	b.deadbolt.Unlock()
+
+	defer func() {
+		b.deadbolt.Lock()
+		delete(b.listeners, l)
+		b.deadbolt.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			b.deadbolt.Lock()
+			closed := b.closed
+			b.deadbolt.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		b.deadbolt.Lock()
+		if b.closed {
+			b.deadbolt.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		b.conns[conn] = struct{}{}
+		b.handlers.Add(1)
+		b.deadbolt.Unlock()
+
+		go func() {
+			defer func() {
+				b.deadbolt.Lock()
+				delete(b.conns, conn)
+				b.deadbolt.Unlock()
+				conn.Close()
+				b.handlers.Done()
+			}()
+			handle(conn)
+		}()
+	}
+
+}
+
+// Close closes all listeners and connections, and waits for the connections
+// being handled to finish.
+func (b *base) Close() error {
+
+	b.deadbolt.Lock()
+	b.closed = true
+	var err error
+	for l := range b.listeners {
+		if closeErr := l.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.deadbolt.Unlock()
+
+	b.handlers.Wait()
+	return err
+
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/hoard"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_UnixSocketAndClose(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.sock")
+	s := NewRESP(hoard.Make(hoard.ExpiresNever))
+
+	served := make(chan error)
+	go func() { served <- s.ListenAndServe("unix", path) }()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn.Write([]byte("PING\r\n"))
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "+PONG\r\n", reply)
+
+	assert.NoError(t, s.Close())
+	assert.Equal(t, ErrServerClosed, <-served)
+
+	// open connections are closed too
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, ErrServerClosed, s.Serve(l))
+
+}
@@ -0,0 +1,578 @@
+package hoard
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shard holds the part of the objects of a hoard whose keys hash to it.
+//
+// Every shard has its own maps, locks and eviction policy, so that threads
+// working with keys in different shards do not contend with each other.
+type shard[K comparable, V any] struct {
+	// cache is a map containing the container objects.
+	cache map[K]*container[V]
+
+	// expirationCache is a map containing the container objects that may
+	// expire, shared with the cache.
+	expirationCache map[K]*container[V]
+
+	// deadlines orders the objects of the expirationCache which expire by
+	// time by when the flush manager next needs to look at them.
+	deadlines deadlines[K, V]
+
+	// conditions holds the objects of the expirationCache with an
+	// expiration condition, which are checked in turn.
+	conditions conditions[K, V]
+
+	// conditionCursor is the position in the conditions at which the next
+	// sweep starts checking them.
+	conditionCursor int
+
+	// refreshing holds the objects of the expirationCache within their
+	// refresh-ahead window, which are checked on every tick.
+	refreshing map[K]*container[V]
+
+	// cacheDeadbolt is used to lock the cache object.
+	cacheDeadbolt sync.RWMutex
+
+	// expirationDeadbolt is used to lock the expirationCache object, the
+	// deadlines, conditions and refreshing objects. It is always acquired
+	// after the cacheDeadbolt.
+	expirationDeadbolt sync.RWMutex
+
+	// loads holds the in-flight dataGetter call for each key being loaded, so
+	// that multiple threads asking for the same key share a single call.
+	loads map[K]*load[V]
+
+	// loadsDeadbolt provides thread safety for the loads map.
+	loadsDeadbolt sync.Mutex
+
+	// maxEntries is the maximum number of objects in the shard, or zero if
+	// the shard is unbounded.
+	maxEntries int
+
+	// maxCost is the maximum total cost of the objects in the shard, or zero
+	// if the cost is unbounded.
+	maxCost int64
+
+	// totalCost is the total cost of the objects in the shard. It is
+	// protected by the cacheDeadbolt.
+	totalCost int64
+
+	// closed is whether the hoard has been closed, after which no objects
+	// are added to the shard. It is protected by the cacheDeadbolt.
+	closed bool
+
+	// evictionPolicy chooses the objects to evict once the shard is full.
+	evictionPolicy EvictionPolicy[K]
+
+	// policyDeadbolt is used to lock the evictionPolicy object. It is always
+	// acquired after the cacheDeadbolt.
+	policyDeadbolt sync.Mutex
+
+	// storeDeadbolt is held while a change to a key of the shard is written
+	// to the backing store and made to the cache, so that concurrent changes
+	// reach both in the same order. It is always acquired before the
+	// cacheDeadbolt.
+	storeDeadbolt sync.Mutex
+
+	// stats counts what happens to the objects of the shard.
+	stats counters
+
+	// clock tells the time.
+	clock Clock
+
+	// lastSweep is when the shard was last swept by Set in the ManualSweep
+	// mode, in nanoseconds since the Unix epoch.
+	lastSweep atomic.Int64
+
+	// log records the changes made to the objects of the shard, or is nil if
+	// the hoard is not durable. Changes are recorded while the cacheDeadbolt
+	// is held, so that they are recorded in order.
+	log *wal[K, V]
+}
+
+// makeShard creates a new *shard object with the given limits, telling the
+// time with clock.
+func makeShard[K comparable, V any](maxEntries int, maxCost int64, clock Clock) *shard[K, V] {
+	return &shard[K, V]{
+		cache:           make(map[K]*container[V]),
+		expirationCache: make(map[K]*container[V]),
+		refreshing:      make(map[K]*container[V]),
+		loads:           make(map[K]*load[V]),
+		maxEntries:      maxEntries,
+		maxCost:         maxCost,
+		evictionPolicy:  NewLRU[K](maxEntries),
+		clock:           clock,
+	}
+}
+
+// expirationCacheLen retrieves the size of the expirationCache atomically.
+func (s *shard[K, V]) expirationCacheLen() int {
+	s.expirationDeadbolt.RLock()
+	length := len(s.expirationCache)
+	s.expirationDeadbolt.RUnlock()
+	return length
+}
+
+// cacheLen retrieves the size of the cache atomically.
+func (s *shard[K, V]) cacheLen() int {
+	s.cacheDeadbolt.RLock()
+	length := len(s.cache)
+	s.cacheDeadbolt.RUnlock()
+	return length
+}
+
+// cacheGet retrieves an object from the cache atomically.
+func (s *shard[K, V]) cacheGet(key K) (*container[V], bool) {
+	s.cacheDeadbolt.RLock()
+	object, ok := s.cache[key]
+	s.cacheDeadbolt.RUnlock()
+	return object, ok
+}
+
+// cacheAdd sets an object in the cache atomically, evicting objects if the
+// shard is full. It returns whether the object was added at all, which is
+// not the case if its cost exceeds the MaxCost budget on its own or the
+// eviction policy has nothing left to evict to make room for it, and the
+// objects that were removed.
+//
+// Replacing an object is treated as removing it and adding the new one.
+func (s *shard[K, V]) cacheAdd(key K, object *container[V]) (bool, []removal[K, V]) {
+	s.cacheDeadbolt.Lock()
+	defer s.cacheDeadbolt.Unlock()
+
+	if s.closed {
+		return false, nil
+	}
+
+	var removals []removal[K, V]
+
+	// the eviction policy keeps tracking a key which is replaced, so that
+	// overwriting a key counts as accessing it rather than starting afresh
+	replaced := s.cacheForget(key)
+	if replaced != nil {
+		removals = append(removals, removal[K, V]{key, replaced, ReplacedBySet})
+	}
+
+	if s.maxCost > 0 && object.cost > s.maxCost {
+		if replaced != nil {
+			s.policyRemoved(key)
+			s.log.remove(key)
+		}
+		return false, removals
+	}
+
+	if s.bounded() {
+		s.policyDeadbolt.Lock()
+
+		// make room before adding the object, so that it cannot be chosen
+		// for eviction itself
+		tracked := replaced != nil
+		for s.full(object.cost) {
+			victim, ok := s.evictionPolicy.Evict()
+			if !ok {
+				// the limits are never exceeded, so the object is
+				// dropped like the one it replaces
+				if tracked {
+					s.evictionPolicy.Removed(key)
+				}
+				s.policyDeadbolt.Unlock()
+				if replaced != nil {
+					s.log.remove(key)
+				}
+				return false, removals
+			}
+			if victim == key {
+				// the replaced object has left the cache already
+				tracked = false
+				continue
+			}
+			if evicted := s.cacheForget(victim); evicted != nil {
+				removals = append(removals, removal[K, V]{victim, evicted, EvictedForCapacity})
+				s.stats.evictions.Add(1)
+				s.log.remove(victim)
+			}
+		}
+
+		if tracked {
+			s.evictionPolicy.Accessed(key)
+		} else {
+			s.evictionPolicy.Added(key)
+		}
+		s.policyDeadbolt.Unlock()
+	}
+
+	s.cache[key] = object
+	s.totalCost += object.cost
+
+	if object.expirable() {
+		s.expirationCacheSet(key, object)
+	}
+
+	s.log.set(key, object)
+
+	return true, removals
+}
+
+// cacheDelete removes an object from the cache, returning it if there was
+// one. The cacheDeadbolt must be held by the caller.
+func (s *shard[K, V]) cacheDelete(key K) (*container[V], bool) {
+	object := s.cacheForget(key)
+	if object == nil {
+		return nil, false
+	}
+	s.policyRemoved(key)
+	return object, true
+}
+
+// cacheExpire removes an expired object from the cache atomically, unless it
+// has been replaced in the meantime. It returns whether the object was
+// removed.
+func (s *shard[K, V]) cacheExpire(key K, object *container[V]) bool {
+	s.cacheDeadbolt.Lock()
+	defer s.cacheDeadbolt.Unlock()
+
+	if s.cache[key] != object {
+		return false
+	}
+
+	s.cacheDelete(key)
+	s.stats.expirations.Add(1)
+	s.log.remove(key)
+	return true
+}
+
+// cacheForget removes an object from the cache without telling the eviction
+// policy, returning it if there was one. The cacheDeadbolt must be held by
+// the caller.
+func (s *shard[K, V]) cacheForget(key K) *container[V] {
+	object, ok := s.cache[key]
+	if !ok {
+		return nil
+	}
+
+	delete(s.cache, key)
+	s.totalCost -= object.cost
+
+	if object.expirable() {
+		s.expirationCacheDelete(key, object)
+	}
+
+	return object
+}
+
+// cacheSetExpiration replaces the object in the cache atomically with a copy
+// using the given expiration. It returns false if there is no such object.
+func (s *shard[K, V]) cacheSetExpiration(key K, expiration *Expiration) bool {
+	s.cacheDeadbolt.Lock()
+	defer s.cacheDeadbolt.Unlock()
+
+	object, ok := s.cache[key]
+	if !ok {
+		return false
+	}
+
+	replacement := &container[V]{
+		data:    object.data,
+		created: object.created,
+		cost:    object.cost,
+		loader:  object.loader,
+		err:     object.err,
+	}
+	replacement.setExpiration(expiration)
+	replacement.accessed.Store(object.accessed.Load())
+
+	s.cache[key] = replacement
+
+	if object.expirable() {
+		s.expirationCacheDelete(key, object)
+	}
+	if replacement.expirable() {
+		s.expirationCacheSet(key, replacement)
+	}
+
+	s.log.setExpiration(key, expiration)
+
+	return true
+}
+
+// clear removes all objects from the shard atomically, returning them.
+func (s *shard[K, V]) clear() []removal[K, V] {
+	s.cacheDeadbolt.Lock()
+	defer s.cacheDeadbolt.Unlock()
+
+	removals := make([]removal[K, V], 0, len(s.cache))
+	for key := range s.cache {
+		object, _ := s.cacheDelete(key)
+		s.stats.removals.Add(1)
+		s.log.remove(key)
+		removals = append(removals, removal[K, V]{key, object, RemovedExplicitly})
+	}
+
+	return removals
+}
+
+// close removes all objects from the shard atomically, without recording the
+// removals in the log, and stops it from taking new ones.
+func (s *shard[K, V]) close() []removal[K, V] {
+	s.cacheDeadbolt.Lock()
+	defer s.cacheDeadbolt.Unlock()
+
+	s.closed = true
+
+	removals := make([]removal[K, V], 0, len(s.cache))
+	for key := range s.cache {
+		object, _ := s.cacheDelete(key)
+		removals = append(removals, removal[K, V]{key, object, RemovedByClose})
+	}
+
+	return removals
+}
+
+// getTotalCost retrieves the total cost of the objects atomically.
+func (s *shard[K, V]) getTotalCost() int64 {
+	s.cacheDeadbolt.RLock()
+	totalCost := s.totalCost
+	s.cacheDeadbolt.RUnlock()
+	return totalCost
+}
+
+// bounded returns whether the number or cost of objects in the shard is
+// limited.
+func (s *shard[K, V]) bounded() bool {
+	return s.maxEntries > 0 || s.maxCost > 0
+}
+
+// full returns whether an object of the given cost can only be added after
+// evicting another one. The cacheDeadbolt must be held by the caller.
+func (s *shard[K, V]) full(cost int64) bool {
+	if s.maxEntries > 0 && len(s.cache) >= s.maxEntries {
+		return true
+	}
+	return s.maxCost > 0 && s.totalCost+cost > s.maxCost
+}
+
+// setEvictionPolicy replaces the eviction policy atomically, adding the keys
+// already in the cache to it, so that they can still be evicted.
+func (s *shard[K, V]) setEvictionPolicy(policy EvictionPolicy[K]) {
+	s.cacheDeadbolt.RLock()
+	defer s.cacheDeadbolt.RUnlock()
+
+	s.policyDeadbolt.Lock()
+	defer s.policyDeadbolt.Unlock()
+
+	if s.bounded() {
+		for key := range s.cache {
+			policy.Added(key)
+		}
+	}
+	s.evictionPolicy = policy
+}
+
+// policyAccessed tells the eviction policy the key has been accessed.
+func (s *shard[K, V]) policyAccessed(key K) {
+	if s.bounded() {
+		s.policyDeadbolt.Lock()
+		s.evictionPolicy.Accessed(key)
+		s.policyDeadbolt.Unlock()
+	}
+}
+
+// policyRemoved tells the eviction policy the key has left the cache. The
+// cacheDeadbolt must be held by the caller.
+func (s *shard[K, V]) policyRemoved(key K) {
+	if s.bounded() {
+		s.policyDeadbolt.Lock()
+		s.evictionPolicy.Removed(key)
+		s.policyDeadbolt.Unlock()
+	}
+}
+
+// expirationCacheSet sets an object in the expirationCache atomically.
+func (s *shard[K, V]) expirationCacheSet(key K, object *container[V]) {
+
+	s.expirationDeadbolt.Lock()
+	s.expirationCache[key] = object
+	s.schedule(key, object, s.clock.Now())
+	s.expirationDeadbolt.Unlock()
+
+}
+
+// expirationCacheDelete removes an object from the expirationCache
+// atomically.
+func (s *shard[K, V]) expirationCacheDelete(key K, object *container[V]) {
+	s.expirationDeadbolt.Lock()
+	if s.expirationCache[key] == object {
+		delete(s.expirationCache, key)
+	}
+	s.unschedule(key, object)
+	s.expirationDeadbolt.Unlock()
+}
+
+// refresh is an object due to be refreshed ahead of its expiration.
+type refresh[K comparable, V any] struct {
+	key    K
+	object *container[V]
+}
+
+// conditionsLen retrieves the number of objects with an expiration
+// condition atomically.
+func (s *shard[K, V]) conditionsLen() int {
+	s.expirationDeadbolt.RLock()
+	length := len(s.conditions)
+	s.expirationDeadbolt.RUnlock()
+	return length
+}
+
+// expireConditions checks the expiration conditions of up to max objects, or
+// all of them if max is zero, carrying on from where the previous call
+// stopped. It removes the objects which are expired at currentTime,
+// returning them along with the number of objects checked.
+func (s *shard[K, V]) expireConditions(currentTime time.Time, max int) ([]removal[K, V], int) {
+
+	var expirations []removal[K, V]
+
+	s.expirationDeadbolt.Lock()
+
+	n := len(s.conditions)
+	if max > 0 && max < n {
+		n = max
+	}
+
+	// the objects are only taken out of the list once they have all been
+	// checked, so that the positions do not change on the way
+	for i := 0; i < n; i++ {
+		if s.conditionCursor >= len(s.conditions) {
+			s.conditionCursor = 0
+		}
+		c := s.conditions[s.conditionCursor]
+		s.conditionCursor++
+		if reason, expired := c.object.removableAt(currentTime); expired {
+			expirations = append(expirations, removal[K, V]{c.key, c.object, reason})
+		}
+	}
+	for _, expiration := range expirations {
+		s.unschedule(expiration.key, expiration.object)
+	}
+
+	s.expirationDeadbolt.Unlock()
+
+	return s.forgetExpired(expirations), n
+
+}
+
+// expireDue looks at up to max of the objects which are due at currentTime,
+// or all of them if max is zero, the earliest first. It removes those which
+// are expired, and puts the others back with their new deadlines. It returns
+// the removed objects, the number of objects looked at and whether more are
+// due.
+func (s *shard[K, V]) expireDue(currentTime time.Time, max int) ([]removal[K, V], int, bool) {
+
+	var expirations []removal[K, V]
+	examined := 0
+
+	s.expirationDeadbolt.Lock()
+
+	now := currentTime.UnixNano()
+	for max == 0 || examined < max {
+		due, ok := s.deadlines.due(now)
+		if !ok {
+			break
+		}
+		examined++
+		s.deadlines.remove(due.object)
+
+		// the deadline is worked out from the access time again, so that
+		// hits do not need to update the deadlines
+		if reason, expired := due.object.removableAt(currentTime); expired {
+			expirations = append(expirations, removal[K, V]{due.key, due.object, reason})
+			continue
+		}
+		s.schedule(due.key, due.object, currentTime)
+	}
+	_, more := s.deadlines.due(now)
+
+	s.expirationDeadbolt.Unlock()
+
+	return s.forgetExpired(expirations), examined, more
+
+}
+
+// refreshes returns the objects due to be refreshed ahead of their
+// expiration at currentTime, forgetting those which have left their
+// refresh-ahead window. The objects returned are forgotten too, so that a
+// failing refresh is not retried on every tick.
+func (s *shard[K, V]) refreshes(currentTime time.Time) []refresh[K, V] {
+
+	var refreshes []refresh[K, V]
+
+	s.expirationDeadbolt.Lock()
+	for key, object := range s.refreshing {
+		if !object.inRefreshWindowAt(currentTime) {
+			delete(s.refreshing, key)
+		} else if object.dueForRefreshAt(currentTime) {
+			delete(s.refreshing, key)
+			refreshes = append(refreshes, refresh[K, V]{key, object})
+		}
+	}
+	s.expirationDeadbolt.Unlock()
+
+	return refreshes
+
+}
+
+// forgetExpired removes the expired objects from the cache atomically,
+// returning those which were still in it.
+func (s *shard[K, V]) forgetExpired(expirations []removal[K, V]) []removal[K, V] {
+
+	if len(expirations) == 0 {
+		return nil
+	}
+
+	removals := expirations[:0]
+
+	s.cacheDeadbolt.Lock()
+	for _, expiration := range expirations {
+		// the object may have been replaced since it was checked
+		if s.cache[expiration.key] == expiration.object {
+			s.cacheDelete(expiration.key)
+			s.stats.expirations.Add(1)
+			s.log.remove(expiration.key)
+			removals = append(removals, expiration)
+		}
+	}
+	s.cacheDeadbolt.Unlock()
+
+	return removals
+
+}
+
+// cacheGetRetained retrieves the data for the key atomically if it has
+// expired by time at currentTime, but is kept to be served because loading
+// it again failed, along with the time it expired.
+func (s *shard[K, V]) cacheGetRetained(key K, currentTime time.Time) (V, time.Time, bool) {
+	var data V
+	object, ok := s.cacheGet(key)
+	if !ok || object.expiration == nil {
+		return data, time.Time{}, false
+	}
+	abs := object.absoluteTime()
+	if !object.expiration.isExpiredByTimeAt(currentTime, abs) || !object.expiration.isRetainedAt(currentTime, abs) {
+		return data, time.Time{}, false
+	}
+	return object.data, object.expiration.expiryTime(abs), true
+}
+
+// snapshot copies the objects of the shard atomically.
+func (s *shard[K, V]) snapshot() map[K]*container[V] {
+	s.cacheDeadbolt.RLock()
+	objects := make(map[K]*container[V], len(s.cache))
+	for key, object := range s.cache {
+		objects[key] = object
+	}
+	s.cacheDeadbolt.RUnlock()
+	return objects
+}
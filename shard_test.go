@@ -0,0 +1,99 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShard_Distribution(t *testing.T) {
+
+	h := Make(ExpiresNever, Shards(4))
+	assert.Equal(t, 4, len(h.shards))
+
+	for i := 0; i < 1000; i++ {
+		h.Set(strconv.Itoa(i), i)
+	}
+
+	assert.Equal(t, 1000, h.len())
+	for _, s := range h.shards {
+		assert.True(t, s.cacheLen() > 0, "every shard should hold some keys")
+	}
+
+	// a key is always found in the same shard
+	assert.Equal(t, h.shard("42"), h.shard("42"))
+	assert.Equal(t, 42, h.Get("42"))
+
+}
+
+func TestShard_Defaults(t *testing.T) {
+
+	assert.Equal(t, DefaultShards, len(Make(ExpiresNever).shards))
+	assert.Equal(t, 1, len(Make(ExpiresNever, MaxEntries(10)).shards))
+	assert.Equal(t, 1, len(Make(ExpiresNever, MaxCost(10)).shards))
+
+}
+
+func TestShard_Limits(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(10), MaxCost(25), Shards(4))
+
+	for _, s := range h.shards {
+		assert.Equal(t, 3, s.maxEntries)
+		assert.Equal(t, int64(7), s.maxCost)
+	}
+
+	for i := 0; i < 100; i++ {
+		h.Set(strconv.Itoa(i), i)
+	}
+
+	assert.True(t, h.len() <= 12)
+
+}
+
+func TestShard_Sweep(t *testing.T) {
+
+	h := Make(ExpiresNever, Shards(1))
+	s := h.shards[0]
+
+	h.Set("expired", 1, Expires().AfterSeconds(1))
+	h.Set("kept", 2, Expires().AfterMinutes(1))
+
+	assert.Equal(t, 1, h.Sweep(time.Now().Add(2*time.Second)))
+
+	assert.False(t, h.Has("expired"))
+	assert.True(t, h.Has("kept"))
+	assert.Equal(t, 1, s.expirationCacheLen())
+
+}
+
+// benchmarkParallelGet reads the same set of keys from many goroutines.
+func benchmarkParallelGet(b *testing.B, h *Hoard) {
+
+	for i := 0; i < 1024; i++ {
+		h.Set(strconv.Itoa(i), i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_ = h.Get(strconv.Itoa(i % 1024))
+			i++
+		}
+	})
+
+}
+
+func BenchmarkHoard_ParallelGet_1Shard(b *testing.B) {
+	benchmarkParallelGet(b, Make(ExpiresNever, Shards(1)))
+}
+
+func BenchmarkHoard_ParallelGet_DefaultShards(b *testing.B) {
+	benchmarkParallelGet(b, Make(ExpiresNever))
+}
+
+func BenchmarkHoard_ParallelGet_64Shards(b *testing.B) {
+	benchmarkParallelGet(b, Make(ExpiresNever, Shards(64)))
+}
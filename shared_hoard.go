@@ -1,6 +1,8 @@
 package hoard
 
 import (
+	"context"
+	"reflect"
 	"sync"
 )
 
@@ -10,6 +12,14 @@ var sharedHoard *Hoard
 // initOnce is used to guarantee that the sharedHoard is initialized only once.
 var initOnce sync.Once
 
+// sharedTypedHoards stores the singleton *TypedHoard instances, keyed by
+// their type.
+var sharedTypedHoards = make(map[reflect.Type]interface{})
+
+// sharedTypedHoardsDeadbolt provides thread safety for the sharedTypedHoards
+// map.
+var sharedTypedHoardsDeadbolt sync.Mutex
+
 // Shared returns the global, shared Hoard object.
 //
 // Using the shared Hoard object and the associated global functions is the
@@ -30,6 +40,33 @@ func Shared() *Hoard {
 
 }
 
+// SharedTyped returns the global, shared TypedHoard object for the key type K
+// and the value type V.
+//
+// Every combination of K and V has its own shared instance, so two packages
+// asking for SharedTyped[int, *User]() will share the same cache. Like the
+// shared Hoard object, it has a default expiration policy of ExpiresNever.
+//
+// Example
+//
+//     user := hoard.SharedTyped[int, *User]().Get(id, loadUser)
+func SharedTyped[K comparable, V any]() *TypedHoard[K, V] {
+
+	sharedTypedHoardsDeadbolt.Lock()
+	defer sharedTypedHoardsDeadbolt.Unlock()
+
+	hoardType := reflect.TypeOf((*TypedHoard[K, V])(nil))
+	if h, ok := sharedTypedHoards[hoardType]; ok {
+		return h.(*TypedHoard[K, V])
+	}
+
+	h := MakeTyped[K, V](ExpiresNever)
+	sharedTypedHoards[hoardType] = h
+
+	return h
+
+}
+
 /*
 	Global shortcut functions for accessing the shared Hoard object
 */
@@ -48,6 +85,35 @@ func GetWithError(key string, dataGetterWithError ...DataGetterWithError) (inter
 	return Shared().GetWithError(key, dataGetterWithError...)
 }
 
+// GetContext gets a value from the shared hoard, giving up once ctx is done.
+//
+// This is a shortcut function, see the Hoard methods for more details.
+func GetContext(ctx context.Context, key string, dataGetter ...DataGetterContext) (interface{}, error) {
+	return Shared().GetContext(ctx, key, dataGetter...)
+}
+
+// GetWithErrorContext gets a value (with error) from the shared hoard, giving
+// up once ctx is done.
+//
+// This is a shortcut function, see the Hoard methods for more details.
+func GetWithErrorContext(ctx context.Context, key string, dataGetterWithError ...DataGetterWithErrorContext) (interface{}, error) {
+	return Shared().GetWithErrorContext(ctx, key, dataGetterWithError...)
+}
+
+// Stats returns the statistics of the shared hoard.
+//
+// This is a shortcut function, see the Hoard methods for more details.
+func Stats() Statistics {
+	return Shared().Stats()
+}
+
+// ResetStats sets all the counters of the shared hoard back to zero.
+//
+// This is a shortcut function, see the Hoard methods for more details.
+func ResetStats() {
+	Shared().ResetStats()
+}
+
 // Remove removes an object by key from the shared hoard.
 //
 // This is a shortcut function, see the Hoard methods for more details.
@@ -1,6 +1,7 @@
 package hoard
 
 import (
+	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -17,6 +18,22 @@ func TestHoard_Shared(t *testing.T) {
 
 }
 
+func TestHoard_SharedTyped(t *testing.T) {
+
+	h := SharedTyped[int, string]()
+	assert.NotNil(t, h)
+
+	h2 := SharedTyped[int, string]()
+	assert.Equal(t, h, h2)
+
+	h.Set(1, "one")
+	assert.Equal(t, "one", h2.Get(1))
+
+	other := SharedTyped[string, string]()
+	assert.False(t, other.Has("1"))
+
+}
+
 func TestShared_Get(t *testing.T) {
 
 	firstCalled := false
@@ -58,6 +75,24 @@ func TestShared_GetWithError(t *testing.T) {
 
 }
 
+func TestShared_GetContext(t *testing.T) {
+
+	result, err := GetContext(context.Background(), "context-key", func(ctx context.Context) (interface{}, *Expiration) {
+		return "first", ExpiresNever
+	})
+
+	assert.Equal(t, "first", result)
+	assert.Nil(t, err)
+
+	result, err = GetWithErrorContext(context.Background(), "context-key2", func(ctx context.Context) (interface{}, error, *Expiration) {
+		return "second", errors.New("EXTERMINATE!!!"), ExpiresNever
+	})
+
+	assert.Equal(t, "second", result)
+	assert.NotNil(t, err)
+
+}
+
 func TestShared_Remove(t *testing.T) {
 
 	Get("something", func() (interface{}, *Expiration) {
@@ -79,7 +114,7 @@ func TestShared_SetExpires(t *testing.T) {
 		return "first", ExpiresNever
 	})
 
-	assert.Equal(t, ExpiresNever, Shared().cache["key"].expiration)
+	assert.Equal(t, ExpiresNever, cached(Shared(), "key").expiration)
 
 	SetExpires("key", Expires().OnDate(date))
 
@@ -90,11 +125,11 @@ func TestShared_SetExpires(t *testing.T) {
 		}
 	}
 
-	// the expiratoin cache item should have its absolute expiration set to the date value as well
-	expirationItem := Shared().expirationCache["key"]
+	// the expiratoin cache item should have its absolute time set to the date value as well
+	expirationItem := expiring(Shared(), "key")
 	if assert.NotNil(t, &expirationItem) {
 		if assert.NotNil(t, expirationItem.expiration, "Expiration should be set") {
-			assert.Equal(t, date, expirationItem.expiration.absolute)
+			assert.True(t, date.Equal(expirationItem.absoluteTime()))
 		}
 	}
 
@@ -110,23 +145,20 @@ func TestShared_SetExpires_Panics(t *testing.T) {
 func TestShared_ExpirationSetting(t *testing.T) {
 
 	result := Get("key2", func() (interface{}, *Expiration) {
-		expiration := new(Expiration)
-		expiration.AfterSecondsIdle(10)
-		expiration.AfterSeconds(10)
-		expiration.OnCondition(func() bool {
+		expiration := new(Expiration).AfterSecondsIdle(10).AfterSeconds(10).OnCondition(func() bool {
 			return true
 		})
 		return "second", expiration
 	})
 
 	assert.Equal(t, result, "second")
-	assert.NotEqual(t, 0, Shared().cache["key2"].expiration.idle)
-	assert.NotEqual(t, 0, Shared().cache["key2"].expiration.duration)
+	assert.NotEqual(t, 0, cached(Shared(), "key2").expiration.idle)
+	assert.NotEqual(t, 0, cached(Shared(), "key2").expiration.duration)
 	assert.Condition(t, func() bool {
-		return Shared().cache["key2"].expiration.condition != nil
+		return cached(Shared(), "key2").expiration.condition != nil
 	})
 	assert.Condition(t, func() bool {
-		return !Shared().cache["key2"].expiration.absolute.IsZero()
+		return !cached(Shared(), "key2").absoluteTime().IsZero()
 	})
 
 }
@@ -0,0 +1,536 @@
+package hoard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrCorruptSnapshot is returned when loading a snapshot which was not
+// written by SaveTo, or which has been truncated or damaged.
+var ErrCorruptSnapshot = errors.New("hoard: corrupt snapshot")
+
+// snapshotMagic starts every snapshot, followed by the format version.
+const snapshotMagic = "HOARD"
+
+// snapshotVersion is the version of the snapshot format written by SaveTo.
+const snapshotVersion = 1
+
+// maxFieldLength is the largest key or data a snapshot is trusted to hold,
+// so that a damaged length cannot make LoadFrom allocate all the memory.
+const maxFieldLength = 1 << 30
+
+// Codec converts keys and data to and from bytes when a hoard is saved to a
+// snapshot and loaded from it.
+//
+// Marshal and Unmarshal are always passed pointers, to the key or data and
+// to the variable to decode into, like encoding/json and encoding/gob.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// GobCodec encodes keys and data with encoding/gob. It is the default codec.
+//
+// Concrete types stored in a Hoard, or in any hoard with an interface type
+// for its data, must be registered with gob.Register to be saved.
+var GobCodec Codec = gobCodec{}
+
+// JSONCodec encodes keys and data with encoding/json.
+//
+// Data stored in a Hoard is loaded as the types encoding/json decodes into an
+// interface{}, such as map[string]interface{}, rather than its original type.
+var JSONCodec Codec = jsonCodec{}
+
+// gobCodec implements GobCodec.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// jsonCodec implements JSONCodec.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// SetCodec sets the codec used to encode keys and data in snapshots.
+//
+// Default is GobCodec, or the codec passed to the WriteAheadLog option, which
+// must not be changed.
+func (h *TypedHoard[K, V]) SetCodec(codec Codec) *TypedHoard[K, V] {
+	h.codec = codec
+	return h
+}
+
+// getCodec returns the codec of the hoard, or the default one.
+func (h *TypedHoard[K, V]) getCodec() Codec {
+	if h.codec == nil {
+		return GobCodec
+	}
+	return h.codec
+}
+
+// expiration kinds, recording which expiration an entry had in a snapshot.
+const (
+	expirationKindDefault byte = iota
+	expirationKindNever
+	expirationKindTime
+	expirationKindStale
+	expirationKindExtended
+)
+
+// maxExtraFields is the largest number of extra fields an expiration of
+// expirationKindExtended is trusted to have.
+const maxExtraFields = 64
+
+// entry is an object as it is written to a snapshot, with its key and data
+// already encoded by the codec.
+type entry struct {
+	key        []byte
+	data       []byte
+	created    int64
+	accessed   int64
+	expiration entryExpiration
+}
+
+// entryExpiration is an expiration policy as it is written to a snapshot.
+type entryExpiration struct {
+
+	// kind tells whether there is no expiration, ExpiresNever or one
+	// described by the idle, duration and date fields, and the extra fields
+	// for expirationKindStale and expirationKindExtended.
+	kind         byte
+	idle         int64
+	duration     int64
+	date         int64
+	stale        int64
+	refreshAhead int64
+	staleIfError int64
+}
+
+// extraFields returns the fields written after the idle, duration and date
+// fields by expirationKindExtended, in order. New fields are only ever
+// added at the end, and readers skip the ones they do not know.
+func (e *entryExpiration) extraFields() []*int64 {
+	return []*int64{&e.stale, &e.refreshAhead, &e.staleIfError}
+}
+
+// makeEntryExpiration makes an entryExpiration from an expiration policy.
+func makeEntryExpiration(expiration *Expiration) entryExpiration {
+	switch expiration {
+	case nil:
+		return entryExpiration{kind: expirationKindDefault}
+	case ExpiresNever:
+		return entryExpiration{kind: expirationKindNever}
+	}
+
+	// conditions are functions, so only the time based fields are kept
+	e := entryExpiration{
+		kind:     expirationKindTime,
+		idle:     int64(expiration.idle),
+		duration: int64(expiration.duration),
+	}
+	if !expiration.date.IsZero() {
+		e.date = expiration.date.UnixNano()
+	}
+	e.stale = int64(expiration.stale)
+	e.refreshAhead = int64(expiration.refreshAhead)
+	e.staleIfError = int64(expiration.staleIfError)
+	for _, field := range e.extraFields() {
+		if *field != 0 {
+			// only policies using the extra fields need them written
+			e.kind = expirationKindExtended
+		}
+	}
+	return e
+}
+
+// policy makes the expiration policy described by the entryExpiration.
+func (e entryExpiration) policy() (*Expiration, error) {
+	switch e.kind {
+	case expirationKindDefault:
+		return nil, nil
+	case expirationKindNever:
+		return ExpiresNever, nil
+	case expirationKindTime, expirationKindStale, expirationKindExtended:
+		expiration := &Expiration{
+			idle:         time.Duration(e.idle),
+			duration:     time.Duration(e.duration),
+			stale:        time.Duration(e.stale),
+			refreshAhead: time.Duration(e.refreshAhead),
+			staleIfError: time.Duration(e.staleIfError),
+		}
+		if e.date != 0 {
+			expiration.date = time.Unix(0, e.date)
+		}
+		return expiration, nil
+	}
+	return nil, ErrCorruptSnapshot
+}
+
+// encodeEntry makes an entry from an object, encoding its key and data.
+func (h *TypedHoard[K, V]) encodeEntry(key K, object *container[V]) (entry, error) {
+	codec := h.getCodec()
+
+	keyBytes, err := codec.Marshal(&key)
+	if err != nil {
+		return entry{}, err
+	}
+	data := object.data
+	dataBytes, err := codec.Marshal(&data)
+	if err != nil {
+		return entry{}, err
+	}
+
+	return entry{
+		key:        keyBytes,
+		data:       dataBytes,
+		created:    object.created.UnixNano(),
+		accessed:   object.accessed.Load(),
+		expiration: makeEntryExpiration(object.expiration),
+	}, nil
+}
+
+// decodeEntry makes an object from an entry, decoding its key and data.
+func (h *TypedHoard[K, V]) decodeEntry(e entry) (K, *container[V], error) {
+	codec := h.getCodec()
+
+	var key K
+	if err := codec.Unmarshal(e.key, &key); err != nil {
+		return key, nil, err
+	}
+	var data V
+	if err := codec.Unmarshal(e.data, &data); err != nil {
+		return key, nil, err
+	}
+	expiration, err := e.expiration.policy()
+	if err != nil {
+		return key, nil, err
+	}
+
+	object := &container[V]{
+		data:    data,
+		created: time.Unix(0, e.created),
+		cost:    h.cost(data),
+	}
+	object.setExpiration(expiration)
+	object.accessed.Store(e.accessed)
+
+	return key, object, nil
+}
+
+// appendEntry appends the binary form of the entry to b.
+func appendEntry(b []byte, e entry) []byte {
+	b = binary.AppendUvarint(b, uint64(len(e.key)))
+	b = append(b, e.key...)
+	b = binary.AppendUvarint(b, uint64(len(e.data)))
+	b = append(b, e.data...)
+	b = binary.AppendVarint(b, e.created)
+	b = binary.AppendVarint(b, e.accessed)
+	return appendEntryExpiration(b, e.expiration)
+}
+
+// appendEntryExpiration appends the binary form of the entryExpiration to b.
+func appendEntryExpiration(b []byte, e entryExpiration) []byte {
+	b = append(b, e.kind)
+	if e.kind == expirationKindDefault || e.kind == expirationKindNever {
+		return b
+	}
+	b = binary.AppendVarint(b, e.idle)
+	b = binary.AppendVarint(b, e.duration)
+	b = binary.AppendVarint(b, e.date)
+	switch e.kind {
+	case expirationKindStale:
+		b = binary.AppendVarint(b, e.stale)
+	case expirationKindExtended:
+		fields := e.extraFields()
+		b = binary.AppendUvarint(b, uint64(len(fields)))
+		for _, field := range fields {
+			b = binary.AppendVarint(b, *field)
+		}
+	}
+	return b
+}
+
+// readEntry reads an entry written by appendEntry. It returns io.EOF if r
+// has no more entries, and ErrCorruptSnapshot if r ends within an entry.
+func readEntry(r *bufio.Reader) (entry, error) {
+	var e entry
+
+	if _, err := r.Peek(1); err != nil {
+		return e, err
+	}
+
+	var err error
+	if e.key, err = readField(r); err != nil {
+		return e, err
+	}
+	if e.data, err = readField(r); err != nil {
+		return e, err
+	}
+	if e.created, err = binary.ReadVarint(r); err != nil {
+		return e, corrupt(err)
+	}
+	if e.accessed, err = binary.ReadVarint(r); err != nil {
+		return e, corrupt(err)
+	}
+	e.expiration, err = readEntryExpiration(r)
+	return e, err
+}
+
+// readEntryExpiration reads an entryExpiration written by
+// appendEntryExpiration.
+func readEntryExpiration(r *bufio.Reader) (entryExpiration, error) {
+	var e entryExpiration
+	var err error
+
+	if e.kind, err = r.ReadByte(); err != nil {
+		return e, corrupt(err)
+	}
+	if e.kind != expirationKindDefault && e.kind != expirationKindNever {
+		if e.idle, err = binary.ReadVarint(r); err != nil {
+			return e, corrupt(err)
+		}
+		if e.duration, err = binary.ReadVarint(r); err != nil {
+			return e, corrupt(err)
+		}
+		if e.date, err = binary.ReadVarint(r); err != nil {
+			return e, corrupt(err)
+		}
+	}
+	switch e.kind {
+	case expirationKindStale:
+		if e.stale, err = binary.ReadVarint(r); err != nil {
+			return e, corrupt(err)
+		}
+	case expirationKindExtended:
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return e, corrupt(err)
+		}
+		if count > maxExtraFields {
+			return e, ErrCorruptSnapshot
+		}
+		fields := e.extraFields()
+		for i := uint64(0); i < count; i++ {
+			value, err := binary.ReadVarint(r)
+			if err != nil {
+				return e, corrupt(err)
+			}
+			if i < uint64(len(fields)) {
+				*fields[i] = value
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// readField reads a length prefixed key or data.
+func readField(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	if length > maxFieldLength {
+		return nil, ErrCorruptSnapshot
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, corrupt(err)
+	}
+	return field, nil
+}
+
+// corrupt turns the error of reading a truncated entry into
+// ErrCorruptSnapshot, leaving other errors of the reader alone.
+func corrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorruptSnapshot
+	}
+	return err
+}
+
+// SaveTo writes a snapshot of the objects in the hoard to w, which can be
+// loaded into a hoard again with LoadFrom.
+//
+// The snapshot holds the keys and data, encoded by the codec set with
+// SetCodec, the times the objects were created and last accessed, and their
+// expiration policies. Only the time based parts of expiration policies are
+// saved, because conditions cannot be. Objects which have already expired
+// are left out.
+//
+// Every shard is copied under its lock in turn, so objects changed while the
+// snapshot is taken may or may not be in it.
+func (h *TypedHoard[K, V]) SaveTo(w io.Writer) error {
+
+	if h.closed.Load() {
+		return ErrClosed
+	}
+
+	out := bufio.NewWriter(w)
+	if _, err := out.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	if err := out.WriteByte(snapshotVersion); err != nil {
+		return err
+	}
+
+	now := h.clock.Now()
+	var b []byte
+
+	for _, s := range h.shards {
+		for key, object := range s.snapshot() {
+			if object.err != nil {
+				continue
+			}
+			if reason, expired := object.expiredAt(now); expired && reason == ExpiredByTime {
+				continue
+			}
+
+			e, err := h.encodeEntry(key, object)
+			if err != nil {
+				return err
+			}
+
+			b = appendEntry(b[:0], e)
+			if _, err := out.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+
+	return out.Flush()
+
+}
+
+// LoadFrom reads a snapshot written by SaveTo from r, storing its objects in
+// the hoard as if they had been Set, with their original creation and access
+// times and expiration policies. Objects which have expired since the
+// snapshot was taken are skipped.
+//
+// Objects are loaded even if the hoard has a different default expiration
+// or limits from the one the snapshot was taken of. If an error occurs, the
+// objects read before it stay in the hoard.
+func (h *TypedHoard[K, V]) LoadFrom(r io.Reader) error {
+
+	if h.closed.Load() {
+		return ErrClosed
+	}
+
+	in := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return corrupt(err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic || header[len(snapshotMagic)] != snapshotVersion {
+		return ErrCorruptSnapshot
+	}
+
+	for {
+		e, err := readEntry(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		key, object, err := h.decodeEntry(e)
+		if err != nil {
+			return err
+		}
+
+		h.restore(key, object)
+	}
+
+}
+
+// restore stores an object loaded from a snapshot, unless it has expired
+// since the snapshot was taken.
+func (h *TypedHoard[K, V]) restore(key K, object *container[V]) {
+
+	if reason, expired := object.expiredAt(h.clock.Now()); expired && reason == ExpiredByTime {
+		return
+	}
+
+	added, removals := h.shard(key).cacheAdd(key, object)
+	h.removed(removals)
+
+	if added && object.expirable() {
+		h.startFlushManager()
+	}
+
+}
+
+// SaveToFile writes a snapshot of the hoard to the file at path, as SaveTo
+// does.
+//
+// The snapshot is written to a temporary file which then replaces the file
+// at path, so that a crash while saving never leaves a partial snapshot.
+func (h *TypedHoard[K, V]) SaveToFile(path string) error {
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := h.SaveTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+
+}
+
+// LoadFromFile reads a snapshot written by SaveToFile from the file at path,
+// as LoadFrom does.
+//
+// A missing file is not an error, so that a process can load its snapshot
+// on start up whether or not it has saved one before.
+func (h *TypedHoard[K, V]) LoadFromFile(path string) error {
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return h.LoadFrom(file)
+
+}
@@ -0,0 +1,159 @@
+package hoard
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveTo_LoadFrom(t *testing.T) {
+
+	h := MakeTyped[int, string](ExpiresNever)
+	h.Set(1, "one")
+	h.Set(2, "two", Expires().AfterHours(1).StaleFor(time.Minute).RefreshAhead(time.Second).StaleIfError(time.Hour))
+	h.Set(3, "three", Expires().AfterMinutesIdle(5).OnDate(time.Now().Add(time.Hour)))
+	h.Set(4, "four", Expires().AfterSeconds(1))
+
+	object, _ := h.cacheGet(4)
+	object.touch(time.Now().Add(-time.Hour))
+
+	var buffer bytes.Buffer
+	assert.NoError(t, h.SaveTo(&buffer))
+
+	loaded := MakeTyped[int, string](nil)
+	assert.NoError(t, loaded.LoadFrom(&buffer))
+
+	assert.Equal(t, 4, loaded.len())
+	for key := 1; key <= 4; key++ {
+		original, _ := h.cacheGet(key)
+		restored, ok := loaded.cacheGet(key)
+		if assert.True(t, ok) {
+			assert.Equal(t, original.data, restored.data)
+			assert.True(t, original.created.Equal(restored.created))
+			assert.True(t, original.lastAccessed().Equal(restored.lastAccessed()))
+		}
+	}
+
+	restored, _ := loaded.cacheGet(1)
+	assert.Equal(t, ExpiresNever, restored.expiration)
+
+	restored, _ = loaded.cacheGet(2)
+	assert.Equal(t, time.Hour, restored.expiration.duration)
+	assert.Equal(t, time.Minute, restored.expiration.stale)
+	assert.Equal(t, time.Second, restored.expiration.refreshAhead)
+	assert.Equal(t, time.Hour, restored.expiration.staleIfError)
+
+	restored, _ = loaded.cacheGet(3)
+	original, _ := h.cacheGet(3)
+	assert.Equal(t, original.expiration.idle, restored.expiration.idle)
+	assert.True(t, original.expiration.date.Equal(restored.expiration.date))
+
+	// the object expires as it would have in the original hoard
+	restored, _ = loaded.cacheGet(4)
+	assert.True(t, restored.expiration.isExpiredByTimeAt(time.Now().Add(2*time.Second), restored.absoluteTime()))
+	assert.Equal(t, 3, loaded.expirationCacheLen())
+
+}
+
+func TestSaveTo_SkipsExpired(t *testing.T) {
+
+	h := MakeTyped[string, int](ExpiresNever)
+	h.Set("expired", 1, Expires().OnDate(time.Now().Add(-time.Second)))
+	h.Set("expiring", 2, Expires().AfterDuration(50*time.Millisecond))
+	h.Set("fresh", 3)
+
+	var buffer bytes.Buffer
+	assert.NoError(t, h.SaveTo(&buffer))
+
+	time.Sleep(100 * time.Millisecond)
+
+	// objects already in the hoard are not replaced by expired ones
+	loaded := MakeTyped[string, int](ExpiresNever)
+	loaded.Set("expiring", 4)
+	assert.NoError(t, loaded.LoadFrom(&buffer))
+
+	assert.False(t, loaded.Has("expired"))
+	assert.Equal(t, 4, loaded.Get("expiring"))
+	assert.Equal(t, 3, loaded.Get("fresh"))
+
+}
+
+func TestSaveTo_Codec(t *testing.T) {
+
+	h := Make(ExpiresNever).SetCodec(JSONCodec)
+	h.Set("object", map[string]interface{}{"name": "Mat"})
+
+	var buffer bytes.Buffer
+	assert.NoError(t, h.SaveTo(&buffer))
+	assert.Contains(t, buffer.String(), `{"name":"Mat"}`)
+
+	loaded := Make(ExpiresNever).SetCodec(JSONCodec)
+	assert.NoError(t, loaded.LoadFrom(&buffer))
+	assert.Equal(t, map[string]interface{}{"name": "Mat"}, loaded.Get("object"))
+
+}
+
+func TestLoadFrom_Corrupt(t *testing.T) {
+
+	h := MakeTyped[string, string](ExpiresNever)
+	h.Set("one", "1")
+	h.Set("two", "2")
+
+	var buffer bytes.Buffer
+	assert.NoError(t, h.SaveTo(&buffer))
+	snapshot := buffer.Bytes()
+
+	loaded := MakeTyped[string, string](ExpiresNever)
+	assert.ErrorIs(t, loaded.LoadFrom(bytes.NewReader(snapshot[:len(snapshot)-1])), ErrCorruptSnapshot)
+	assert.Equal(t, 1, loaded.len())
+
+	assert.ErrorIs(t, loaded.LoadFrom(bytes.NewReader([]byte("not a snapshot"))), ErrCorruptSnapshot)
+	assert.ErrorIs(t, loaded.LoadFrom(bytes.NewReader(nil)), ErrCorruptSnapshot)
+
+}
+
+func TestSaveToFile_LoadFromFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.snapshot")
+
+	loaded := MakeTyped[string, int](ExpiresNever)
+	assert.NoError(t, loaded.LoadFromFile(path))
+	assert.Equal(t, 0, loaded.len())
+
+	h := MakeTyped[string, int](ExpiresNever)
+	h.Set("one", 1)
+	assert.NoError(t, h.SaveToFile(path))
+	h.Set("two", 2)
+	assert.NoError(t, h.SaveToFile(path))
+
+	assert.NoError(t, loaded.LoadFromFile(path))
+	assert.Equal(t, 1, loaded.Get("one"))
+	assert.Equal(t, 2, loaded.Get("two"))
+
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	assert.Equal(t, []string{path}, files)
+
+}
+
+func TestReadEntryExpiration_Extended(t *testing.T) {
+
+	// expirations with the stale field only are still read
+	b := appendEntryExpiration(nil, entryExpiration{kind: expirationKindStale, duration: 1, stale: 2})
+	e, err := readEntryExpiration(bufio.NewReader(bytes.NewReader(b)))
+	assert.NoError(t, err)
+	assert.Equal(t, entryExpiration{kind: expirationKindStale, duration: 1, stale: 2}, e)
+
+	// extra fields written by newer versions are skipped
+	b = []byte{expirationKindExtended, 0, 2, 0, 4, 4, 6, 8, 10}
+	b = append(b, 'x')
+	r := bufio.NewReader(bytes.NewReader(b))
+	e, err = readEntryExpiration(r)
+	assert.NoError(t, err)
+	assert.Equal(t, entryExpiration{kind: expirationKindExtended, duration: 1, stale: 2, refreshAhead: 3, staleIfError: 4}, e)
+	next, _ := r.ReadByte()
+	assert.Equal(t, byte('x'), next)
+
+}
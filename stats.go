@@ -0,0 +1,160 @@
+package hoard
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LoadTimeBuckets are the upper bounds of the buckets of the
+// LoadTimeHistogram in the Statistics of a hoard.
+var LoadTimeBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Statistics describes how a hoard has been used since it was made, or since
+// its statistics were last reset.
+type Statistics struct {
+
+	// Hits is the number of times data was found in the cache.
+	Hits uint64
+
+	// ErrorHits is the number of times an error cached with CacheError was
+	// found in the cache.
+	ErrorHits uint64
+
+	// Misses is the number of times data was not found in the cache, whether
+	// or not it was then provided by a DataGetter.
+	Misses uint64
+
+	// Loads is the number of times a DataGetter was called.
+	Loads uint64
+
+	// LoadErrors is the number of times a DataGetter returned an error or
+	// panicked.
+	LoadErrors uint64
+
+	// LoadTime is the total time spent in DataGetters.
+	LoadTime time.Duration
+
+	// LoadTimeHistogram counts the DataGetter calls by how long they took.
+	// Each count is for the calls that took longer than the previous bound
+	// in LoadTimeBuckets, and no longer than the bound at the same index.
+	// Calls that took longer than all bounds are not counted in any bucket.
+	LoadTimeHistogram [len(LoadTimeBuckets)]uint64
+
+	// Expirations is the number of objects removed because they expired.
+	Expirations uint64
+
+	// Evictions is the number of objects evicted to keep the hoard within its
+	// MaxEntries or MaxCost limits.
+	Evictions uint64
+
+	// Removals is the number of objects removed by calling Remove.
+	Removals uint64
+
+	// Entries is the number of objects currently in the cache. It is not
+	// affected by resetting the statistics.
+	Entries int
+}
+
+// HitRatio returns the share of lookups that found their data in the cache,
+// or zero if there have not been any. Lookups finding a cached error count
+// as lookups, but not as hits.
+func (s Statistics) HitRatio() float64 {
+	lookups := s.Hits + s.ErrorHits + s.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(lookups)
+}
+
+// counters holds the statistics of a shard. They are updated atomically, so
+// that collecting them needs no locks.
+type counters struct {
+	hits        atomic.Uint64
+	errorHits   atomic.Uint64
+	misses      atomic.Uint64
+	loads       atomic.Uint64
+	loadErrors  atomic.Uint64
+	loadTime    atomic.Int64
+	loadTimes   [len(LoadTimeBuckets)]atomic.Uint64
+	expirations atomic.Uint64
+	evictions   atomic.Uint64
+	removals    atomic.Uint64
+}
+
+// observeLoad counts a DataGetter call that took the given time.
+func (c *counters) observeLoad(loadTime time.Duration) {
+	c.loads.Add(1)
+	c.loadTime.Add(int64(loadTime))
+	for i, bound := range LoadTimeBuckets {
+		if loadTime <= bound {
+			c.loadTimes[i].Add(1)
+			return
+		}
+	}
+}
+
+// addTo adds the counters to the statistics.
+func (c *counters) addTo(stats *Statistics) {
+	stats.Hits += c.hits.Load()
+	stats.ErrorHits += c.errorHits.Load()
+	stats.Misses += c.misses.Load()
+	stats.Loads += c.loads.Load()
+	stats.LoadErrors += c.loadErrors.Load()
+	stats.LoadTime += time.Duration(c.loadTime.Load())
+	for i := range c.loadTimes {
+		stats.LoadTimeHistogram[i] += c.loadTimes[i].Load()
+	}
+	stats.Expirations += c.expirations.Load()
+	stats.Evictions += c.evictions.Load()
+	stats.Removals += c.removals.Load()
+}
+
+// reset sets all the counters back to zero.
+func (c *counters) reset() {
+	c.hits.Store(0)
+	c.errorHits.Store(0)
+	c.misses.Store(0)
+	c.loads.Store(0)
+	c.loadErrors.Store(0)
+	c.loadTime.Store(0)
+	for i := range c.loadTimes {
+		c.loadTimes[i].Store(0)
+	}
+	c.expirations.Store(0)
+	c.evictions.Store(0)
+	c.removals.Store(0)
+}
+
+// Stats returns the statistics of the hoard.
+//
+// The counters are collected from every shard without stopping other
+// threads, so they may be slightly out of step with each other on a busy
+// hoard.
+func (h *TypedHoard[K, V]) Stats() Statistics {
+	var stats Statistics
+	for _, s := range h.shards {
+		s.stats.addTo(&stats)
+	}
+	stats.Entries = h.len()
+	return stats
+}
+
+// ResetStats sets all the counters of the hoard back to zero.
+func (h *TypedHoard[K, V]) ResetStats() {
+	for _, s := range h.shards {
+		s.stats.reset()
+	}
+}
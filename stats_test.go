@@ -0,0 +1,86 @@
+package hoard
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+
+	h := Make(ExpiresNever, MaxEntries(2))
+
+	h.Get("one", func() (interface{}, *Expiration) {
+		time.Sleep(time.Millisecond)
+		return 1, ExpiresNever
+	})
+	h.Get("one")
+	h.Get("missing")
+	h.GetWithError("error", func() (interface{}, error, *Expiration) {
+		return nil, errors.New("EXTERMINATE!!!"), ExpiresNever
+	})
+	h.Set("two", 2)
+	h.Set("three", 3)
+	h.Remove("three")
+	h.Remove("three")
+	h.Set("expired", 4, Expires().OnCondition(func() bool { return true }))
+	h.Get("expired")
+
+	stats := h.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(4), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Loads)
+	assert.Equal(t, uint64(1), stats.LoadErrors)
+	assert.True(t, stats.LoadTime >= time.Millisecond)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(1), stats.Removals)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, 0.2, stats.HitRatio())
+
+	h.ResetStats()
+
+	assert.Equal(t, Statistics{Entries: 1}, h.Stats())
+	assert.Equal(t, float64(0), h.Stats().HitRatio())
+
+}
+
+func TestStats_Sweep(t *testing.T) {
+
+	h := Make(ExpiresNever, Shards(1))
+	h.Set("key", 1, Expires().AfterSeconds(1))
+
+	h.Sweep(time.Now().Add(2 * time.Second))
+
+	assert.Equal(t, uint64(1), h.Stats().Expirations)
+	assert.Equal(t, 0, h.Stats().Entries)
+
+}
+
+func TestStats_Shared(t *testing.T) {
+
+	ResetStats()
+	Get("stats-key")
+
+	assert.Equal(t, uint64(1), Stats().Misses)
+	assert.Equal(t, Shared().Stats(), Stats())
+
+}
+
+func TestStats_LoadTimeHistogram(t *testing.T) {
+
+	var c counters
+	c.observeLoad(time.Millisecond)
+	c.observeLoad(3 * time.Millisecond)
+	c.observeLoad(time.Minute)
+
+	var stats Statistics
+	c.addTo(&stats)
+
+	assert.Equal(t, uint64(3), stats.Loads)
+	assert.Equal(t, uint64(1), stats.LoadTimeHistogram[0])
+	assert.Equal(t, uint64(1), stats.LoadTimeHistogram[1])
+	assert.Equal(t, uint64(0), stats.LoadTimeHistogram[len(LoadTimeBuckets)-1])
+
+}
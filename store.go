@@ -0,0 +1,380 @@
+package hoard
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Store is a backing store holding the data of a hoard beyond its lifetime,
+// such as a database, which the hoard reads through on misses and writes
+// changes to.
+//
+// A Store must be safe for concurrent use.
+type Store[K comparable, V any] interface {
+
+	// Load loads the data for the key, returning false if there is none.
+	Load(ctx context.Context, key K) (V, bool, error)
+
+	// LoadMany loads the data for the keys, leaving the keys without data
+	// out of the map.
+	LoadMany(ctx context.Context, keys []K) (map[K]V, error)
+
+	// Save saves the data for the key.
+	Save(ctx context.Context, key K, data V) error
+
+	// Delete deletes the data for the key.
+	Delete(ctx context.Context, key K) error
+}
+
+// errNotInStore is returned by the dataGetter reading through to the store
+// when it has no data for the key, so that nothing is cached.
+var errNotInStore = errors.New("hoard: not in store")
+
+// SetStore sets the backing store of the hoard.
+//
+// Once it is set, Get and its alternatives called without a DataGetter load
+// missing data from the store, with the default expiration policy of the
+// hoard. Set and Remove write through to the store before changing the
+// cache, unless write-behind is turned on with SetWriteBehind. Data provided
+// by DataGetters is not saved to the store, nor are objects removed from the
+// store when they expire, are evicted or are cleared.
+//
+// Errors returned by the store when writing are passed to the callback set
+// with OnStoreError. SetWithError returns them instead.
+//
+// This function should be called right after Make()
+func (h *TypedHoard[K, V]) SetStore(store Store[K, V]) *TypedHoard[K, V] {
+	h.store = store
+	return h
+}
+
+// SetWriteBehind makes Set and Remove queue their changes to the backing
+// store instead of writing them through, and writes the queued changes every
+// interval, ticking with the Clock of the hoard. Changes to the same key are
+// coalesced, so that only the last one is written, with one call to Save or
+// Delete per key.
+//
+// Until they are written, misses read the queued changes rather than the
+// store. Changes that fail to be written are passed to the callback set with
+// OnStoreError and retried the next time the changes are written. Use Flush
+// to write the queued changes immediately, and Close to write them and stop
+// the background writer.
+//
+// With the ManualSweep option, no background writer is started either, and
+// the queued changes are only written by Flush and Close.
+//
+// This function should be called right after SetStore()
+func (h *TypedHoard[K, V]) SetWriteBehind(interval time.Duration) *TypedHoard[K, V] {
+	h.writeBehind = makeWriteBehind(h, interval)
+	return h
+}
+
+// OnStoreError sets the callback called with the errors returned by the
+// backing store when changes made by Set and Remove are written to it.
+func (h *TypedHoard[K, V]) OnStoreError(callback func(key K, err error)) *TypedHoard[K, V] {
+	h.onStoreError = callback
+	return h
+}
+
+// SetWithError stores an object in the cache for the given key as Set does,
+// but returns the error of writing it through to the backing store, in
+// which case the object is not cached.
+//
+// With write-behind, the object is only queued to be written, so no error is
+// returned, unless the hoard has been closed in the meantime.
+func (h *TypedHoard[K, V]) SetWithError(key K, object V, expiration ...*Expiration) error {
+	return h.set(key, object, h.cost(object), expiration...)
+}
+
+// GetMany retrieves the data for the keys, loading the missing ones from the
+// backing store with a single call to LoadMany. Keys without data are left
+// out of the map.
+func (h *TypedHoard[K, V]) GetMany(ctx context.Context, keys []K) (map[K]V, error) {
+
+	if h.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	found := make(map[K]V, len(keys))
+	var missing []K
+
+	for _, key := range keys {
+		if data, ok := h.lookup(key); ok {
+			found[key] = data
+			continue
+		}
+		if h.store == nil {
+			continue
+		}
+		if data, deleted, queued := h.writeBehind.queued(key); queued {
+			if !deleted {
+				found[key] = data
+			}
+			continue
+		}
+		missing = append(missing, key)
+	}
+
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	loaded, err := h.store.LoadMany(ctx, missing)
+	if err != nil {
+		return found, err
+	}
+	for key, data := range loaded {
+		h.add(key, data, h.cost(data), h.defaultExpiration)
+		found[key] = data
+	}
+
+	return found, nil
+
+}
+
+// readThrough returns the dataGetter loading the data for the key from the
+// backing store.
+func (h *TypedHoard[K, V]) readThrough(key K) TypedDataGetterWithErrorContext[V] {
+	return func(ctx context.Context) (V, error, *Expiration) {
+
+		// queued changes are newer than the store
+		if data, deleted, queued := h.writeBehind.queued(key); queued {
+			if deleted {
+				return data, errNotInStore, nil
+			}
+			return data, nil, ExpiresDefault
+		}
+
+		data, ok, err := h.store.Load(ctx, key)
+		if err == nil && !ok {
+			err = errNotInStore
+		}
+		return data, err, ExpiresDefault
+	}
+}
+
+// save writes the data for the key to the backing store, or queues it with
+// write-behind.
+func (h *TypedHoard[K, V]) save(key K, data V) error {
+	if h.store == nil {
+		return nil
+	}
+	if h.writeBehind != nil {
+		return h.writeBehind.queue(key, pendingWrite[V]{data: data})
+	}
+	return h.store.Save(context.Background(), key, data)
+}
+
+// delete deletes the data for the key from the backing store, or queues the
+// deletion with write-behind.
+func (h *TypedHoard[K, V]) delete(key K) error {
+	if h.store == nil {
+		return nil
+	}
+	if h.writeBehind != nil {
+		return h.writeBehind.queue(key, pendingWrite[V]{deleted: true})
+	}
+	return h.store.Delete(context.Background(), key)
+}
+
+// lockStore locks the storeDeadbolt of the shard if the hoard has a backing
+// store, returning the function unlocking it.
+func (h *TypedHoard[K, V]) lockStore(s *shard[K, V]) func() {
+	if h.store == nil {
+		return func() {}
+	}
+	s.storeDeadbolt.Lock()
+	return s.storeDeadbolt.Unlock
+}
+
+// storeFailed passes an error of the backing store to the OnStoreError
+// callback, if there is one. Changes which were not queued by write-behind
+// because the hoard was closed in the meantime are not reported.
+func (h *TypedHoard[K, V]) storeFailed(key K, err error) {
+	if h.onStoreError != nil && err != ErrClosed {
+		h.onStoreError(key, err)
+	}
+}
+
+// Flush writes the changes queued by write-behind to the backing store,
+// returning the errors of the changes that failed to be written. It does
+// nothing without write-behind.
+func (h *TypedHoard[K, V]) Flush() error {
+	if h.closed.Load() {
+		return ErrClosed
+	}
+	if h.writeBehind == nil {
+		return nil
+	}
+	return h.writeBehind.flush()
+}
+
+// pendingWrite is a change queued by write-behind.
+type pendingWrite[V any] struct {
+
+	// data is the data to save.
+	data V
+
+	// deleted is whether the data is to be deleted instead.
+	deleted bool
+}
+
+// writeBehind queues the changes to the backing store of a hoard, and writes
+// them in the background.
+type writeBehind[K comparable, V any] struct {
+
+	// hoard is the hoard whose changes are written.
+	hoard *TypedHoard[K, V]
+
+	// pending holds the latest queued change for each key.
+	pending map[K]pendingWrite[V]
+
+	// writing holds the changes being written, which are still newer than
+	// the store.
+	writing map[K]pendingWrite[V]
+
+	// closed is whether changes are no longer queued, as the writer has
+	// been closed.
+	closed bool
+
+	// pendingDeadbolt provides thread safety for the pending and writing
+	// maps, and the closed flag.
+	pendingDeadbolt sync.Mutex
+
+	// flushDeadbolt makes sure the changes are written by one thread at a
+	// time.
+	flushDeadbolt sync.Mutex
+
+	// stop is closed to stop the background writer.
+	stop chan struct{}
+
+	// stopped is closed once the background writer has stopped.
+	stopped chan struct{}
+
+	// closeOnce makes sure the background writer is only stopped once.
+	closeOnce sync.Once
+}
+
+// makeWriteBehind creates a new *writeBehind object and starts writing the
+// changes every interval, unless the hoard sweeps manually.
+func makeWriteBehind[K comparable, V any](h *TypedHoard[K, V], interval time.Duration) *writeBehind[K, V] {
+	w := &writeBehind[K, V]{
+		hoard:   h,
+		pending: make(map[K]pendingWrite[V]),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if h.manualSweep {
+		close(w.stopped)
+		return w
+	}
+
+	ticker := h.clock.NewTicker(interval)
+	go func() {
+		defer close(w.stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				w.flush()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+// queue queues a change atomically, replacing any queued change for the key.
+// It returns ErrClosed once the writer has been closed, as the change would
+// never be written.
+func (w *writeBehind[K, V]) queue(key K, write pendingWrite[V]) error {
+	w.pendingDeadbolt.Lock()
+	defer w.pendingDeadbolt.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	w.pending[key] = write
+	return nil
+}
+
+// queued returns the change queued or being written for the key, if any.
+func (w *writeBehind[K, V]) queued(key K) (V, bool, bool) {
+	if w == nil {
+		var data V
+		return data, false, false
+	}
+
+	w.pendingDeadbolt.Lock()
+	defer w.pendingDeadbolt.Unlock()
+
+	write, ok := w.pending[key]
+	if !ok {
+		write, ok = w.writing[key]
+	}
+	return write.data, write.deleted, ok
+}
+
+// flush writes the queued changes to the store, queueing the failed ones
+// again unless they have been replaced in the meantime.
+func (w *writeBehind[K, V]) flush() error {
+
+	w.flushDeadbolt.Lock()
+	defer w.flushDeadbolt.Unlock()
+
+	w.pendingDeadbolt.Lock()
+	changes := w.pending
+	w.pending = make(map[K]pendingWrite[V])
+	w.writing = changes
+	w.pendingDeadbolt.Unlock()
+
+	store := w.hoard.store
+	ctx := context.Background()
+	var errs []error
+
+	for key, write := range changes {
+		var err error
+		if write.deleted {
+			err = store.Delete(ctx, key)
+		} else {
+			err = store.Save(ctx, key, write.data)
+		}
+		if err == nil {
+			continue
+		}
+
+		errs = append(errs, err)
+		w.hoard.storeFailed(key, err)
+
+		w.pendingDeadbolt.Lock()
+		if _, replaced := w.pending[key]; !replaced {
+			w.pending[key] = write
+		}
+		w.pendingDeadbolt.Unlock()
+	}
+
+	w.pendingDeadbolt.Lock()
+	w.writing = nil
+	w.pendingDeadbolt.Unlock()
+
+	return errors.Join(errs...)
+
+}
+
+// close stops queueing changes and the background writer, and writes the
+// changes queued until then.
+func (w *writeBehind[K, V]) close() error {
+	w.closeOnce.Do(func() {
+		w.pendingDeadbolt.Lock()
+		w.closed = true
+		w.pendingDeadbolt.Unlock()
+		close(w.stop)
+	})
+	<-w.stopped
+	return w.flush()
+}
@@ -0,0 +1,328 @@
+package hoard
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a Store keeping its data in a map, recording the calls made
+// to it.
+type memoryStore struct {
+	data  map[string]int
+	calls []string
+	err   error
+	sync.Mutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string]int)}
+}
+
+func (m *memoryStore) Load(ctx context.Context, key string) (int, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.calls = append(m.calls, "load "+key)
+	data, ok := m.data[key]
+	return data, ok, m.err
+}
+
+func (m *memoryStore) LoadMany(ctx context.Context, keys []string) (map[string]int, error) {
+	m.Lock()
+	defer m.Unlock()
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	m.calls = append(m.calls, "loadMany "+strings.Join(sorted, ","))
+	loaded := make(map[string]int)
+	for _, key := range keys {
+		if data, ok := m.data[key]; ok {
+			loaded[key] = data
+		}
+	}
+	return loaded, m.err
+}
+
+func (m *memoryStore) Save(ctx context.Context, key string, data int) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls = append(m.calls, "save "+key)
+	if m.err != nil {
+		return m.err
+	}
+	m.data[key] = data
+	return nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls = append(m.calls, "delete "+key)
+	if m.err != nil {
+		return m.err
+	}
+	delete(m.data, key)
+	return nil
+}
+
+// takeCalls returns the calls made to the store since the last time.
+func (m *memoryStore) takeCalls() []string {
+	m.Lock()
+	defer m.Unlock()
+	calls := m.calls
+	m.calls = nil
+	return calls
+}
+
+func TestStore_ReadThrough(t *testing.T) {
+
+	store := newMemoryStore()
+	store.data["one"] = 1
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store)
+
+	assert.Equal(t, 1, h.Get("one"))
+	assert.Equal(t, 1, h.Get("one"))
+	assert.Equal(t, 0, h.Get("missing"))
+	assert.False(t, h.Has("missing"))
+
+	// call sites providing a DataGetter still use it
+	assert.Equal(t, 2, h.Get("two", func() (int, *Expiration) { return 2, ExpiresDefault }))
+
+	assert.Equal(t, []string{"load one", "load missing"}, store.takeCalls())
+
+	stats := h.Stats()
+	assert.Equal(t, uint64(3), stats.Loads)
+	assert.Equal(t, uint64(0), stats.LoadErrors)
+
+	store.err = errors.New("EXTERMINATE!!!")
+	_, err := h.GetWithError("broken")
+	assert.Equal(t, store.err, err)
+
+}
+
+func TestStore_WriteThrough(t *testing.T) {
+
+	store := newMemoryStore()
+	var failed []string
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store).OnStoreError(func(key string, err error) {
+		failed = append(failed, key)
+	})
+
+	h.Set("one", 1)
+	h.Remove("one")
+	h.Set("two", 2)
+	h.Clear()
+
+	assert.Equal(t, []string{"save one", "delete one", "save two"}, store.takeCalls())
+	assert.Equal(t, map[string]int{"two": 2}, store.data)
+
+	store.err = errors.New("EXTERMINATE!!!")
+	assert.Equal(t, store.err, h.SetWithError("three", 3))
+	assert.False(t, h.Has("three"))
+
+	h.Set("four", 4)
+	assert.False(t, h.Has("four"))
+
+	// objects which fail to be deleted from the store stay in the cache
+	store.err = nil
+	h.Set("five", 5)
+	store.err = errors.New("EXTERMINATE!!!")
+	h.Remove("five")
+	assert.True(t, h.Has("five"))
+	assert.Equal(t, []string{"four", "five"}, failed)
+
+}
+
+// deleteOrderStore is a memoryStore recording whether the keys it deletes
+// are still cached at the time.
+type deleteOrderStore struct {
+	*memoryStore
+	cached         func(key string) bool
+	cachedOnDelete []bool
+}
+
+func (d *deleteOrderStore) Delete(ctx context.Context, key string) error {
+	d.cachedOnDelete = append(d.cachedOnDelete, d.cached(key))
+	return d.memoryStore.Delete(ctx, key)
+}
+
+func TestStore_RemoveDeletesFirst(t *testing.T) {
+
+	store := &deleteOrderStore{memoryStore: newMemoryStore()}
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store)
+	store.cached = h.Has
+
+	// a Get racing the Remove cannot read the old data through again, as
+	// it is gone from the store before it leaves the cache
+	h.Set("one", 1)
+	h.Remove("one")
+
+	assert.Equal(t, []bool{true}, store.cachedOnDelete)
+	assert.False(t, h.Has("one"))
+	assert.Equal(t, 0, h.Get("one"))
+
+}
+
+func TestStore_GetMany(t *testing.T) {
+
+	store := newMemoryStore()
+	store.data["two"] = 2
+	store.data["three"] = 3
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store)
+	h.Set("one", 1)
+	store.takeCalls()
+
+	found, err := h.GetMany(context.Background(), []string{"one", "two", "three", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"one": 1, "two": 2, "three": 3}, found)
+	assert.Equal(t, []string{"loadMany missing,three,two"}, store.takeCalls())
+	assert.True(t, h.Has("three"))
+
+}
+
+func TestStore_WriteBehind(t *testing.T) {
+
+	store := newMemoryStore()
+	store.data["gone"] = 1
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store).SetWriteBehind(time.Hour)
+
+	h.Set("key", 1)
+	h.Set("key", 2)
+	h.Set("key", 3)
+	h.Remove("gone")
+	assert.Empty(t, store.takeCalls())
+
+	// misses see the queued changes rather than the store
+	h.Clear()
+	assert.Equal(t, 3, h.Get("key"))
+	assert.Equal(t, 0, h.Get("gone"))
+	assert.Empty(t, store.takeCalls())
+
+	assert.NoError(t, h.Flush())
+	calls := store.takeCalls()
+	sort.Strings(calls)
+	assert.Equal(t, []string{"delete gone", "save key"}, calls)
+	assert.Equal(t, map[string]int{"key": 3}, store.data)
+
+	h.Set("other", 4)
+	assert.NoError(t, h.Close())
+	assert.Equal(t, 4, store.data["other"])
+
+}
+
+func TestStore_WriteBehindRetries(t *testing.T) {
+
+	store := newMemoryStore()
+	store.err = errors.New("EXTERMINATE!!!")
+	var failed []string
+	h := MakeTyped[string, int](ExpiresNever).SetStore(store).SetWriteBehind(time.Hour).OnStoreError(func(key string, err error) {
+		failed = append(failed, key)
+	})
+
+	h.Set("key", 1)
+	assert.ErrorIs(t, h.Flush(), store.err)
+	assert.Equal(t, []string{"key"}, failed)
+
+	store.Lock()
+	store.err = nil
+	store.Unlock()
+
+	assert.NoError(t, h.Close())
+	assert.Equal(t, 1, store.data["key"])
+
+}
+
+func TestStore_WriteBehindInBackground(t *testing.T) {
+
+	store := newMemoryStore()
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](ExpiresNever, WithClock(clock)).SetStore(store).SetWriteBehind(10 * time.Millisecond)
+	defer h.Close()
+
+	h.Set("key", 1)
+	assert.Empty(t, store.takeCalls())
+
+	clock.Advance(10 * time.Millisecond)
+
+	assert.Condition(t, func() bool {
+		for i := 0; i < 100; i++ {
+			store.Lock()
+			_, ok := store.data["key"]
+			store.Unlock()
+			if ok {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	})
+
+}
+
+func TestStore_WriteBehindManualSweep(t *testing.T) {
+
+	store := newMemoryStore()
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](ExpiresNever, WithClock(clock), ManualSweep()).SetStore(store).SetWriteBehind(10 * time.Millisecond)
+
+	h.Set("key", 1)
+	assert.Equal(t, 0, tickers(clock))
+
+	clock.Advance(time.Second)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, store.takeCalls())
+
+	assert.NoError(t, h.Close())
+	assert.Equal(t, 1, store.data["key"])
+
+}
+
+// slowStore is a memoryStore taking a while to return from Save, after the
+// data has been saved.
+type slowStore struct {
+	*memoryStore
+}
+
+func (s slowStore) Save(ctx context.Context, key string, data int) error {
+	err := s.memoryStore.Save(ctx, key, data)
+	time.Sleep(time.Duration(data%3) * time.Millisecond)
+	return err
+}
+
+func TestStore_ConcurrentWriteThrough(t *testing.T) {
+
+	store := newMemoryStore()
+	h := MakeTyped[string, int](ExpiresNever).SetStore(slowStore{store})
+
+	for round := 0; round < 100; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(data int) {
+				defer wg.Done()
+				if data%2 == 0 {
+					h.Set("key", data)
+				} else {
+					h.Remove("key")
+				}
+			}(round*4 + i)
+		}
+		wg.Wait()
+
+		store.Lock()
+		stored, ok := store.data["key"]
+		store.Unlock()
+		cached, found := h.shard("key").cacheGet("key")
+		if !assert.Equal(t, ok, found) {
+			return
+		}
+		if ok {
+			assert.Equal(t, stored, cached.data)
+		}
+	}
+
+}
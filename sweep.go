@@ -0,0 +1,145 @@
+package hoard
+
+import (
+	"time"
+)
+
+// sweepBatch is the number of objects a sweep looks at while holding the
+// locks of a shard, before releasing them for other threads.
+const sweepBatch = 256
+
+// sweepBudget is what is left of the work a sweep may do, as set with the
+// SweepBudget option.
+type sweepBudget struct {
+
+	// keys is the number of objects left to look at, or -1 if there is no
+	// limit.
+	keys int
+
+	// until is when the sweep has to stop, or the zero time if there is no
+	// limit. It is measured by the system clock, as it limits the work of
+	// the sweep rather than expiring objects.
+	until time.Time
+}
+
+// newSweepBudget makes the budget for a new sweep.
+func (h *TypedHoard[K, V]) newSweepBudget() *sweepBudget {
+	b := &sweepBudget{keys: -1}
+	if h.sweepKeys > 0 {
+		b.keys = h.sweepKeys
+	}
+	if h.sweepDuration > 0 {
+		b.until = time.Now().Add(h.sweepDuration)
+	}
+	return b
+}
+
+// batch returns the number of objects the next batch may look at, which is
+// zero once the budget has run out.
+func (b *sweepBudget) batch() int {
+	if !b.until.IsZero() && !time.Now().Before(b.until) {
+		return 0
+	}
+	if b.keys < 0 {
+		return sweepBatch
+	}
+	return min(b.keys, sweepBatch)
+}
+
+// spend takes the number of objects looked at off the budget.
+func (b *sweepBudget) spend(n int) {
+	if b.keys >= 0 {
+		b.keys -= n
+	}
+}
+
+// Sweep removes the objects which are expired at now, and starts refreshing
+// the objects due to be refreshed ahead of their expiration, as the flush
+// manager does on every tick. It returns the number of objects removed.
+//
+// Sweep is meant for hoards made with the ManualSweep option, where the
+// application drives expiration, but may be called on any hoard. Closed
+// hoards have nothing to sweep. The work done by Sweep is limited by the
+// SweepBudget option, in which case it may need to be called again to remove
+// all the expired objects.
+//
+// Example
+//
+//     h := hoard.Make(hoard.Expires().AfterMinutes(5), hoard.ManualSweep())
+//     ...
+//     removed := h.Sweep(time.Now())
+func (h *TypedHoard[K, V]) Sweep(now time.Time) int {
+	budget := h.newSweepBudget()
+	start := int(h.sweepStart.Add(1) % uint64(len(h.shards)))
+
+	removed := 0
+	for i := range h.shards {
+		removed += h.sweepShard(h.shards[(start+i)%len(h.shards)], now, budget)
+	}
+	return removed
+}
+
+// sweepShard removes the objects of the shard which are expired at now, in
+// batches until the budget runs out or the hoard is closed, returning how
+// many there were. The
+// expiration conditions are checked at most once each.
+func (h *TypedHoard[K, V]) sweepShard(s *shard[K, V], now time.Time, budget *sweepBudget) int {
+
+	removed := 0
+
+	for unchecked := s.conditionsLen(); unchecked > 0; {
+		n := min(budget.batch(), unchecked)
+		if n == 0 || h.closed.Load() {
+			break
+		}
+		removals, checked := s.expireConditions(now, n)
+		if checked == 0 {
+			break
+		}
+		budget.spend(checked)
+		unchecked -= checked
+		removed += len(removals)
+		h.removed(removals)
+	}
+
+	for {
+		n := budget.batch()
+		if n == 0 || h.closed.Load() {
+			break
+		}
+		removals, examined, more := s.expireDue(now, n)
+		budget.spend(examined)
+		removed += len(removals)
+		h.removed(removals)
+		if !more {
+			break
+		}
+	}
+
+	h.refresh(s, s.refreshes(now))
+
+	return removed
+
+}
+
+// sweepShardIfDue sweeps the shard if it has not been swept by Set for the
+// expiration check interval, spreading the sweeps of a hoard made with the
+// ManualSweep option over the calls to Set.
+//
+// The sweep looks at a single batch of objects at most, whatever the
+// SweepBudget, so that Set never takes long.
+func (h *TypedHoard[K, V]) sweepShardIfDue(s *shard[K, V]) {
+	now := h.clock.Now()
+	last := s.lastSweep.Load()
+	if now.UnixNano()-last < int64(h.expirationCheckInterval) {
+		return
+	}
+	// only one caller sweeps the shard, the others carry on
+	if s.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		budget := h.newSweepBudget()
+		if budget.keys < 0 || budget.keys > sweepBatch {
+			budget.keys = sweepBatch
+		}
+		h.sweepShard(s, now, budget)
+	}
+}
@@ -0,0 +1,160 @@
+package hoard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHoard_Sweep(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](Expires().AfterSeconds(10), WithClock(clock), ManualSweep())
+
+	var evicted []string
+	h.OnEvict(func(key string, data int, reason RemovalReason) {
+		evicted = append(evicted, key)
+	})
+
+	h.Set("one", 1)
+	h.Set("two", 2, Expires().AfterSeconds(30))
+	h.Set("three", 3, ExpiresNever)
+
+	// no flush manager is started
+	assert.Equal(t, 0, tickers(clock))
+
+	clock.Advance(20 * time.Second)
+	assert.True(t, h.Has("one"))
+
+	assert.Equal(t, 1, h.Sweep(clock.Now()))
+	assert.Equal(t, []string{"one"}, evicted)
+	assert.False(t, h.Has("one"))
+
+	assert.Equal(t, 0, h.Sweep(clock.Now()))
+	assert.Equal(t, 1, h.Sweep(clock.Now().Add(time.Minute)))
+	assert.True(t, h.Has("three"))
+
+}
+
+func TestHoard_SweepDuringSet(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[string, int](ExpiresNever, WithClock(clock), ManualSweep(), Shards(1))
+	h.SetExpirationCheckInterval(time.Second)
+
+	h.Set("expiring", 1, Expires().AfterSeconds(1))
+	clock.Advance(2 * time.Second)
+
+	// the shard was last swept when the first object was set
+	h.Set("other", 2)
+	assert.False(t, h.Has("expiring"))
+
+	// the shard is swept at most once every expiration check interval
+	h.Set("expiring", 1, Expires().AfterDuration(100*time.Millisecond))
+	clock.Advance(500 * time.Millisecond)
+	h.Set("other", 2)
+	assert.True(t, h.Has("expiring"))
+
+	clock.Advance(500 * time.Millisecond)
+	h.Set("other", 2)
+	assert.False(t, h.Has("expiring"))
+	assert.Equal(t, 0, tickers(clock))
+
+}
+
+func TestHoard_SweepDuringSetIsLimited(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[int, int](ExpiresNever, WithClock(clock), ManualSweep(), Shards(1))
+	h.SetExpirationCheckInterval(time.Second)
+
+	for i := 0; i < 1000; i++ {
+		h.Set(i, i, Expires().AfterSeconds(1))
+	}
+	clock.Advance(2 * time.Second)
+
+	// a single batch is swept by Set, even without a SweepBudget
+	h.Set(-1, -1)
+	assert.Equal(t, 1001-sweepBatch, h.len())
+	assert.Equal(t, 1000-sweepBatch, h.Sweep(clock.Now()))
+
+}
+
+func TestHoard_SweepBudget(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[int, int](ExpiresNever, WithClock(clock), ManualSweep(), Shards(4), SweepBudget(300, 0))
+
+	var evicted []int
+	h.OnEvict(func(key int, data int, reason RemovalReason) {
+		evicted = append(evicted, key)
+	})
+
+	// the objects expire in the order of their keys
+	for i := 0; i < 1000; i++ {
+		h.Set(i, i, Expires().AfterDuration(time.Second+time.Duration(i)*time.Millisecond))
+	}
+	clock.Advance(time.Minute)
+
+	// every sweep carries on where the previous one stopped
+	assert.Equal(t, 300, h.Sweep(clock.Now()))
+	assert.Equal(t, 300, h.Sweep(clock.Now()))
+	assert.Equal(t, 300, h.Sweep(clock.Now()))
+	assert.Equal(t, 100, h.Sweep(clock.Now()))
+	assert.Equal(t, 0, h.Sweep(clock.Now()))
+	assert.Equal(t, 1000, len(evicted))
+
+	// within a shard, the objects which expired first are removed first
+	for _, s := range h.shards {
+		previous := -1
+		for _, key := range evicted {
+			if h.shard(key) == s {
+				assert.True(t, key > previous)
+				previous = key
+			}
+		}
+	}
+
+}
+
+func TestHoard_SweepBudgetConditions(t *testing.T) {
+
+	clock := NewFakeClock(time.Now())
+	h := MakeTyped[int, int](ExpiresNever, WithClock(clock), ManualSweep(), Shards(1), SweepBudget(3, 0))
+
+	expired := false
+	for i := 0; i < 10; i++ {
+		h.Set(i, i, Expires().OnCondition(func() bool { return false }))
+	}
+	h.Set(10, 10, Expires().OnCondition(func() bool { return expired }))
+	expired = true
+
+	// the conditions are checked in turn, three at a time
+	removed := 0
+	for i := 0; i < 4; i++ {
+		removed += h.Sweep(clock.Now())
+	}
+	assert.Equal(t, 1, removed)
+	assert.False(t, h.Has(10))
+	assert.Equal(t, 10, len(h.shards[0].conditions))
+
+}
+
+func TestSweepBudget_Batch(t *testing.T) {
+
+	b := &sweepBudget{keys: -1}
+	assert.Equal(t, sweepBatch, b.batch())
+	b.spend(1000)
+	assert.Equal(t, sweepBatch, b.batch())
+
+	b = &sweepBudget{keys: 300}
+	assert.Equal(t, sweepBatch, b.batch())
+	b.spend(sweepBatch)
+	assert.Equal(t, 300-sweepBatch, b.batch())
+	b.spend(300 - sweepBatch)
+	assert.Equal(t, 0, b.batch())
+
+	b = &sweepBudget{keys: -1, until: time.Now().Add(-time.Second)}
+	assert.Equal(t, 0, b.batch())
+
+}
@@ -0,0 +1,574 @@
+package hoard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// minCompactionSize is the size the log of a durable hoard must reach before
+// it is compacted in the background. Beyond that, it is compacted whenever
+// it grows larger than twice the last snapshot.
+const minCompactionSize = 4 << 20
+
+// log record operations.
+const (
+	walSet byte = iota + 1
+	walRemove
+	walSetExpiration
+)
+
+// walHeaderSize is the size of the length and checksum before each record.
+const walHeaderSize = 8
+
+// walChecksums is the table used to checksum the records.
+var walChecksums = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is returned when reading a record at the end of the log
+// which was not completely written, which ends the log.
+var errTornRecord = errors.New("hoard: torn log record")
+
+// ErrCorruptLog is returned by LogError when a record before the end of the
+// write-ahead log is damaged. The records after it are not restored, and the
+// log files are left as they are.
+var ErrCorruptLog = errors.New("hoard: corrupt log")
+
+// wal is the write-ahead log of a durable hoard, recording every change made
+// to its objects so that they can be restored when the hoard is made again.
+//
+// The changes are appended to the log file while the shard of the object is
+// locked, so they are recorded in the order in which they were made.
+type wal[K comparable, V any] struct {
+
+	// hoard is the hoard whose changes are logged.
+	hoard *TypedHoard[K, V]
+
+	// path is the path of the log file. Compaction writes the snapshot to
+	// path + ".snapshot", and moves the log to path + ".old" while it does.
+	path string
+
+	// file is the log file changes are appended to, or nil once the log is
+	// closed.
+	file *os.File
+
+	// size is the size of the log file.
+	size int64
+
+	// snapshotSize is the size of the snapshot written by the last
+	// compaction.
+	snapshotSize int64
+
+	// compacting is whether a background compaction has been started.
+	compacting bool
+
+	// err is the first error the log ran into.
+	err error
+
+	// walDeadbolt provides thread safety for the fields above. It is always
+	// acquired after the cacheDeadbolt of a shard.
+	walDeadbolt sync.Mutex
+
+	// compactionDeadbolt makes sure only one compaction runs at a time.
+	compactionDeadbolt sync.Mutex
+}
+
+// snapshotPath returns the path of the snapshot of the log.
+func (w *wal[K, V]) snapshotPath() string {
+	return w.path + ".snapshot"
+}
+
+// oldPath returns the path the log is moved to while it is compacted.
+func (w *wal[K, V]) oldPath() string {
+	return w.path + ".old"
+}
+
+// openLog restores the objects recorded by the log at path, then compacts it
+// and starts logging the changes made to the hoard.
+//
+// If the log cannot be restored, the hoard is left without a log and its
+// files are left alone, so that no data is lost.
+func (h *TypedHoard[K, V]) openLog(path string) {
+
+	w := &wal[K, V]{hoard: h, path: path}
+	h.log = w
+
+	// the snapshot and logs are replayed from oldest to newest
+	err := h.LoadFromFile(w.snapshotPath())
+	if err == nil {
+		err = w.replay(w.oldPath())
+	}
+	if err == nil {
+		err = w.replay(w.path)
+	}
+
+	// the restored objects should not count as activity
+	h.ResetStats()
+
+	if err == nil {
+		err = w.rewrite()
+	}
+	if err != nil {
+		w.err = err
+		return
+	}
+
+	for _, s := range h.shards {
+		s.log = w
+	}
+
+}
+
+// rewrite writes a fresh snapshot of the hoard and starts an empty log,
+// before the hoard is logging to it.
+func (w *wal[K, V]) rewrite() error {
+
+	if err := w.hoard.SaveToFile(w.snapshotPath()); err != nil {
+		return err
+	}
+	if err := removeIfExists(w.oldPath()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(w.snapshotPath())
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.snapshotSize = info.Size()
+	return nil
+
+}
+
+// replay applies the changes recorded in the log file at path to the hoard.
+// A missing file has no changes, and a torn record at the end of the log is
+// dropped. A damaged record anywhere else stops the replay with
+// ErrCorruptLog.
+func (w *wal[K, V]) replay(path string) error {
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	in := bufio.NewReader(file)
+	for {
+		record, err := readRecord(in)
+		if err == io.EOF || err == errTornRecord {
+			// a record torn by a crash was never acknowledged to anyone
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.apply(record); err != nil {
+			return err
+		}
+	}
+
+}
+
+// apply applies a change recorded in the log to the hoard.
+func (w *wal[K, V]) apply(record []byte) error {
+	h := w.hoard
+	codec := h.getCodec()
+	r := bufio.NewReader(bytes.NewReader(record[1:]))
+
+	switch record[0] {
+	case walSet:
+		e, err := readEntry(r)
+		if err != nil {
+			return corrupt(err)
+		}
+		key, object, err := h.decodeEntry(e)
+		if err != nil {
+			return err
+		}
+		w.restore(key, object)
+
+	case walRemove:
+		keyBytes, err := readField(r)
+		if err != nil {
+			return err
+		}
+		var key K
+		if err := codec.Unmarshal(keyBytes, &key); err != nil {
+			return err
+		}
+		h.Remove(key)
+
+	case walSetExpiration:
+		keyBytes, err := readField(r)
+		if err != nil {
+			return err
+		}
+		e, err := readEntryExpiration(r)
+		if err != nil {
+			return err
+		}
+		var key K
+		if err := codec.Unmarshal(keyBytes, &key); err != nil {
+			return err
+		}
+		expiration, err := e.policy()
+		if err != nil {
+			return err
+		}
+		h.SetExpires(key, expiration)
+
+	default:
+		return ErrCorruptSnapshot
+	}
+
+	return nil
+}
+
+// restore stores an object recorded as set by the log. If it has expired,
+// any object restored for the key earlier is removed instead, as the expired
+// one replaced it.
+func (w *wal[K, V]) restore(key K, object *container[V]) {
+
+	h := w.hoard
+	if reason, expired := object.expiredAt(h.clock.Now()); !expired || reason != ExpiredByTime {
+		h.restore(key, object)
+		return
+	}
+
+	s := h.shard(key)
+	s.cacheDeadbolt.Lock()
+	replaced, ok := s.cacheDelete(key)
+	s.cacheDeadbolt.Unlock()
+
+	if ok {
+		h.removed([]removal[K, V]{{key, replaced, ReplacedBySet}})
+	}
+
+}
+
+// readRecord reads a record from the log, checking its checksum. It returns
+// io.EOF at the end of the log, and errTornRecord if the last record of the
+// log was not completely written, or if the log ends with zeros where the
+// next record would be. A damaged record which is followed by more of the log
+// cannot have been torn by a crash, so ErrCorruptLog is returned for it
+// instead.
+func readRecord(r *bufio.Reader) ([]byte, error) {
+
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length == 0 {
+		// a crash can leave the end of the log filled with zeros rather than
+		// cut short, when the file was extended before the data reached it
+		if zeroTail(r) {
+			return nil, errTornRecord
+		}
+		return nil, ErrCorruptLog
+	}
+	if length > 3*maxFieldLength {
+		// the record may have been torn, if the log ends before it would
+		if n, _ := r.Discard(int(length)); n < int(length) || atEnd(r) {
+			return nil, errTornRecord
+		}
+		return nil, ErrCorruptLog
+	}
+
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+
+	if crc32.Checksum(record, walChecksums) != binary.LittleEndian.Uint32(header[4:]) {
+		if atEnd(r) {
+			return nil, errTornRecord
+		}
+		return nil, ErrCorruptLog
+	}
+
+	return record, nil
+}
+
+// zeroTail reads the rest of r, returning whether it is all zeros.
+func zeroTail(r *bufio.Reader) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err == io.EOF
+		}
+		if b != 0 {
+			return false
+		}
+	}
+}
+
+// atEnd returns whether nothing is left to read from r.
+func atEnd(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err != nil
+}
+
+// set records that the object was stored for the key.
+func (w *wal[K, V]) set(key K, object *container[V]) {
+	if w == nil {
+		return
+	}
+	if object.err != nil {
+		// cached errors are not restored, but they replace any data
+		w.remove(key)
+		return
+	}
+	e, err := w.hoard.encodeEntry(key, object)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	w.append(appendEntry([]byte{walSet}, e))
+}
+
+// remove records that the object for the key left the cache.
+func (w *wal[K, V]) remove(key K) {
+	if w == nil {
+		return
+	}
+	keyBytes, err := w.hoard.getCodec().Marshal(&key)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	record := binary.AppendUvarint([]byte{walRemove}, uint64(len(keyBytes)))
+	w.append(append(record, keyBytes...))
+}
+
+// setExpiration records that the expiration policy of the object for the key
+// was replaced.
+func (w *wal[K, V]) setExpiration(key K, expiration *Expiration) {
+	if w == nil {
+		return
+	}
+	keyBytes, err := w.hoard.getCodec().Marshal(&key)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	record := binary.AppendUvarint([]byte{walSetExpiration}, uint64(len(keyBytes)))
+	record = append(record, keyBytes...)
+	w.append(appendEntryExpiration(record, makeEntryExpiration(expiration)))
+}
+
+// append writes a record to the log file atomically, starting a compaction
+// if the log has grown large enough.
+func (w *wal[K, V]) append(record []byte) {
+
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(record))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(record, walChecksums))
+	frame = append(frame, record...)
+
+	w.walDeadbolt.Lock()
+	defer w.walDeadbolt.Unlock()
+
+	if w.file == nil {
+		return
+	}
+
+	n, err := w.file.Write(frame)
+	w.size += int64(n)
+	if err != nil {
+		w.failLocked(err)
+		return
+	}
+
+	if !w.compacting && w.err == nil && w.size >= minCompactionSize && w.size >= 2*w.snapshotSize {
+		w.compacting = true
+		go w.hoard.Compact()
+	}
+
+}
+
+// fail records the first error the log ran into atomically.
+func (w *wal[K, V]) fail(err error) {
+	w.walDeadbolt.Lock()
+	w.failLocked(err)
+	w.walDeadbolt.Unlock()
+}
+
+// failLocked records the first error the log ran into. The walDeadbolt must be
+// held by the caller.
+func (w *wal[K, V]) failLocked(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// compact replaces the log with a snapshot of the hoard.
+//
+// New changes go to a fresh log while the snapshot is written, and the old
+// log is only removed once the snapshot is complete. Replaying the snapshot
+// and both logs restores the same objects at any point, so a crash during
+// compaction loses nothing.
+func (w *wal[K, V]) compact() error {
+
+	w.compactionDeadbolt.Lock()
+	defer w.compactionDeadbolt.Unlock()
+
+	defer func() {
+		w.walDeadbolt.Lock()
+		w.compacting = false
+		w.walDeadbolt.Unlock()
+	}()
+
+	w.walDeadbolt.Lock()
+	if w.file == nil || w.err != nil {
+		err := w.err
+		w.walDeadbolt.Unlock()
+		return err
+	}
+	err := w.rotate()
+	if err != nil {
+		w.failLocked(err)
+	}
+	w.walDeadbolt.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := w.hoard.SaveToFile(w.snapshotPath()); err != nil {
+		w.fail(err)
+		return err
+	}
+	if err := os.Remove(w.oldPath()); err != nil {
+		w.fail(err)
+		return err
+	}
+
+	info, err := os.Stat(w.snapshotPath())
+	if err != nil {
+		w.fail(err)
+		return err
+	}
+
+	w.walDeadbolt.Lock()
+	w.snapshotSize = info.Size()
+	w.walDeadbolt.Unlock()
+
+	return nil
+
+}
+
+// rotate moves the log aside and starts a fresh one. The walDeadbolt must be
+// held by the caller.
+func (w *wal[K, V]) rotate() error {
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if err := os.Rename(w.path, w.oldPath()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.size = 0
+	return nil
+
+}
+
+// close closes the log file atomically.
+func (w *wal[K, V]) close() error {
+
+	// wait for a compaction to finish writing its snapshot
+	w.compactionDeadbolt.Lock()
+	defer w.compactionDeadbolt.Unlock()
+
+	w.walDeadbolt.Lock()
+	defer w.walDeadbolt.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+
+}
+
+// removeIfExists removes the file at path, unless there is no such file.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Compact replaces the write-ahead log of the hoard with a fresh snapshot,
+// so that restoring the hoard does not have to replay every change made to
+// it. The log is compacted in the background once it grows large, so there
+// is usually no need to call Compact.
+//
+// Compact does nothing for hoards made without the WriteAheadLog option.
+func (h *TypedHoard[K, V]) Compact() error {
+	if h.log == nil {
+		return nil
+	}
+	return h.log.compact()
+}
+
+// LogError returns the first error the write-ahead log of the hoard ran into,
+// or nil if there was none.
+//
+// If the log could not be restored when the hoard was made, the hoard only
+// holds the objects restored before the error, and does not log its changes
+// so that the files of the log are left alone.
+// Once the log has run into an error it stops compacting, but keeps logging
+// changes as well as it can.
+func (h *TypedHoard[K, V]) LogError() error {
+	if h.log == nil {
+		return nil
+	}
+	h.log.walDeadbolt.Lock()
+	defer h.log.walDeadbolt.Unlock()
+	return h.log.err
+}
+
+// CloseLog flushes and closes the write-ahead log of the hoard. Changes made
+// to the hoard afterwards are no longer logged.
+//
+// CloseLog does nothing for hoards made without the WriteAheadLog option.
+func (h *TypedHoard[K, V]) CloseLog() error {
+	if h.log == nil {
+		return nil
+	}
+	return h.log.close()
+}
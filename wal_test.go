@@ -0,0 +1,342 @@
+package hoard
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeDurable makes a durable hoard logging to path.
+func makeDurable(path string) *TypedHoard[string, int] {
+	return MakeTyped[string, int](ExpiresNever, WriteAheadLog(path, nil))
+}
+
+func TestWriteAheadLog(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	assert.NoError(t, h.LogError())
+
+	h.Set("one", 1)
+	h.Set("two", 2)
+	h.Set("two", 22)
+	h.Set("three", 3)
+	h.Remove("three")
+	h.Set("four", 4)
+	h.SetExpires("four", Expires().AfterHours(1))
+	h.Set("expired", 5, Expires().AfterSeconds(1))
+	h.Sweep(time.Now().Add(2 * time.Second))
+	h.Get("loaded", func() (int, *Expiration) { return 6, ExpiresDefault })
+
+	assert.NoError(t, h.CloseLog())
+	assert.NoError(t, h.LogError())
+
+	restored := makeDurable(path)
+	assert.NoError(t, restored.LogError())
+
+	assert.Equal(t, 4, restored.len())
+	assert.Equal(t, 1, restored.Get("one"))
+	assert.Equal(t, 22, restored.Get("two"))
+	assert.False(t, restored.Has("three"))
+	assert.False(t, restored.Has("expired"))
+	assert.Equal(t, 6, restored.Get("loaded"))
+
+	object, _ := restored.cacheGet("four")
+	assert.Equal(t, time.Hour, object.expiration.duration)
+	assert.Equal(t, 1, restored.expirationCacheLen())
+
+	assert.Equal(t, Statistics{Hits: 3, Entries: 4}, restored.Stats())
+
+}
+
+func TestWriteAheadLog_RestoredUnderPolicy(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+	options := []Option{
+		MaxEntries(3),
+		WriteAheadLog(path, nil),
+		WithEvictionPolicy(NewLFU[string]),
+		WithCoster(func(data int) int64 { return int64(data) * 10 }),
+	}
+
+	h := MakeTyped[string, int](ExpiresNever, options...)
+	h.Set("one", 1)
+	h.Set("two", 2)
+	h.Set("three", 3)
+	assert.NoError(t, h.CloseLog())
+
+	// the restored objects are weighed by the coster and evicted by the
+	// policy given as options
+	restored := MakeTyped[string, int](ExpiresNever, options...)
+	assert.Equal(t, int64(60), restored.TotalCost())
+	restored.Get("one")
+	restored.Get("three")
+	restored.Set("four", 4)
+	assert.Equal(t, 3, restored.len())
+	assert.False(t, restored.Has("two"))
+	assert.NoError(t, restored.CloseLog())
+
+	// policies set after Make are told about the restored objects too
+	restored = MakeTyped[string, int](ExpiresNever, MaxEntries(3), WriteAheadLog(path, nil)).SetEvictionPolicy(NewLFU[string])
+	restored.Set("five", 5)
+	assert.Equal(t, 3, restored.len())
+	assert.NoError(t, restored.CloseLog())
+
+	assert.Panics(t, func() {
+		MakeTyped[int, int](ExpiresNever, WithEvictionPolicy(NewLFU[string]))
+	})
+	assert.Panics(t, func() {
+		MakeTyped[string, string](ExpiresNever, WithCoster(func(data int) int64 { return 1 }))
+	})
+
+}
+
+func TestWriteAheadLog_ExpiredWhileDown(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("key", 1)
+	h.Set("key", 2, Expires().AfterDuration(50*time.Millisecond))
+	assert.NoError(t, h.CloseLog())
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the object does not come back as it was before it was replaced
+	restored := makeDurable(path)
+	assert.False(t, restored.Has("key"))
+
+}
+
+func TestWriteAheadLog_TornRecord(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("one", 1)
+	h.Set("two", 2)
+	assert.NoError(t, h.CloseLog())
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-1))
+
+	restored := makeDurable(path)
+	assert.NoError(t, restored.LogError())
+	assert.True(t, restored.Has("one"))
+	assert.False(t, restored.Has("two"))
+
+}
+
+func TestWriteAheadLog_ZeroTail(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("one", 1)
+	h.Set("two", 2)
+	assert.NoError(t, h.CloseLog())
+
+	log, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, append(log, make([]byte, 4096)...), 0644))
+
+	restored := makeDurable(path)
+	assert.NoError(t, restored.LogError())
+	assert.Equal(t, 1, restored.Get("one"))
+	assert.Equal(t, 2, restored.Get("two"))
+
+	// the zeros are dropped, so the records logged after them are restored
+	restored.Set("three", 3)
+	assert.NoError(t, restored.CloseLog())
+
+	reopened := makeDurable(path)
+	assert.NoError(t, reopened.LogError())
+	assert.Equal(t, 3, reopened.len())
+	assert.Equal(t, 3, reopened.Get("three"))
+
+}
+
+func TestWriteAheadLog_ZeroHeader(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("one", 1)
+	assert.NoError(t, h.CloseLog())
+
+	// an empty record followed by more of the log was not torn by a crash
+	log, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	damaged := append(make([]byte, walHeaderSize), log...)
+	assert.NoError(t, os.WriteFile(path, damaged, 0644))
+
+	restored := makeDurable(path)
+	assert.ErrorIs(t, restored.LogError(), ErrCorruptLog)
+	assert.False(t, restored.Has("one"))
+
+}
+
+func TestWriteAheadLog_Checksum(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("one", 1)
+	h.Set("two", 2)
+	assert.NoError(t, h.CloseLog())
+
+	log, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	log[len(log)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, log, 0644))
+
+	restored := makeDurable(path)
+	assert.NoError(t, restored.LogError())
+	assert.True(t, restored.Has("one"))
+	assert.False(t, restored.Has("two"))
+
+}
+
+func TestWriteAheadLog_CorruptRecord(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("one", 1)
+	h.Set("two", 2)
+	h.Set("three", 3)
+	assert.NoError(t, h.CloseLog())
+
+	// damage the record in the middle
+	log, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	second := walHeaderSize + int(binary.LittleEndian.Uint32(log[:4]))
+	log[second+walHeaderSize+1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, log, 0644))
+
+	// the replay stops at the damaged record
+	restored := makeDurable(path)
+	assert.ErrorIs(t, restored.LogError(), ErrCorruptLog)
+	assert.True(t, restored.Has("one"))
+	assert.False(t, restored.Has("two"))
+	assert.False(t, restored.Has("three"))
+
+	// the log is left for someone to look at, rather than compacted away
+	kept, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, log, kept)
+
+}
+
+func TestWriteAheadLog_Compact(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	for i := 0; i < 100; i++ {
+		h.Set("key", i)
+	}
+
+	info, _ := os.Stat(path)
+	assert.True(t, info.Size() > 0)
+
+	assert.NoError(t, h.Compact())
+
+	info, _ = os.Stat(path)
+	assert.Equal(t, int64(0), info.Size())
+	_, err := os.Stat(path + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+	h.Set("other", 1)
+	assert.NoError(t, h.CloseLog())
+
+	restored := makeDurable(path)
+	assert.Equal(t, 99, restored.Get("key"))
+	assert.Equal(t, 1, restored.Get("other"))
+
+}
+
+func TestWriteAheadLog_InterruptedCompaction(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+
+	h := makeDurable(path)
+	h.Set("one", 1)
+	h.Set("two", 2)
+	assert.NoError(t, h.CloseLog())
+
+	// a crash after moving the log aside, before the snapshot was written
+	assert.NoError(t, os.Rename(path, path+".old"))
+	assert.NoError(t, os.WriteFile(path, nil, 0644))
+
+	restored := makeDurable(path)
+	assert.NoError(t, restored.LogError())
+	assert.Equal(t, 1, restored.Get("one"))
+	assert.Equal(t, 2, restored.Get("two"))
+
+	_, err := os.Stat(path + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+}
+
+func TestWriteAheadLog_Unrestorable(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+	assert.NoError(t, os.WriteFile(path+".snapshot", []byte("not a snapshot"), 0644))
+
+	h := makeDurable(path)
+	assert.ErrorIs(t, h.LogError(), ErrCorruptSnapshot)
+
+	// the hoard still works, but leaves the files alone
+	h.Set("one", 1)
+	assert.Equal(t, 1, h.Get("one"))
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	snapshot, _ := os.ReadFile(path + ".snapshot")
+	assert.Equal(t, "not a snapshot", string(snapshot))
+
+}
+
+func TestWriteAheadLog_CompactConcurrently(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "hoard.log")
+	h := makeDurable(path)
+
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 200; i++ {
+				key := strconv.Itoa(w*1000 + i%50)
+				if i%7 == 0 {
+					h.Remove(key)
+				} else {
+					h.Set(key, i)
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, h.Compact())
+	}
+	writers.Wait()
+	assert.NoError(t, h.CloseLog())
+
+	restored := makeDurable(path)
+	assert.Equal(t, h.len(), restored.len())
+	for _, s := range h.shards {
+		for key, object := range s.snapshot() {
+			assert.Equal(t, object.data, restored.Get(key))
+		}
+	}
+
+}